@@ -1,25 +0,0 @@
-package app
-
-import (
-	"net/http"
-)
-
-//when required we'll apply auth
-var JwtAuthentication = func(next http.Handler) http.Handler {
-
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		notAuth := []string{"/api/blocks/me/{id}"}
-		//current request path
-		requestPath := r.URL.Path
-
-		//check if request does not need authentication, serve the request if it doesn't need it
-		for _, value := range notAuth {
-
-			if value == requestPath {
-				next.ServeHTTP(w, r)
-				return
-			}
-		}
-	})
-}
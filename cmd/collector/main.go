@@ -5,6 +5,11 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/iov-one/block-metrics/pkg/errors"
 	"github.com/iov-one/block-metrics/pkg/metrics"
@@ -14,14 +19,57 @@ func main() {
 	conf := configuration{
 		PostgresURI:     env("POSTGRES_URI", "user=postgres dbname=postgres"),
 		TendermintWsURI: env("TENDERMINT_WS_URI", "wss://bns.lovenet.iov.one/websocket"),
+		RecordDir:       env("TENDERMINT_RECORD_DIR", ""),
+		Sync: metrics.SyncConfig{
+			Workers:    envInt("SYNC_WORKERS", 4),
+			Prefetch:   envInt("SYNC_PREFETCH", 32),
+			BatchSize:  envInt("SYNC_BATCH_SIZE", 100),
+			FetchBatch: envInt("SYNC_FETCH_BATCH", 10),
+			Retry: metrics.RetryPolicy{
+				MaxAttempts:    envInt("SYNC_RETRY_ATTEMPTS", 5),
+				InitialBackoff: envDuration("SYNC_RETRY_BACKOFF", 500*time.Millisecond),
+				MaxBackoff:     envDuration("SYNC_RETRY_MAX_BACKOFF", 30*time.Second),
+			},
+		},
 	}
+	conf.Sync.NodeURI = conf.TendermintWsURI
 
-	if err := run(conf); err != nil {
+	// Synchronization is the default command.
+	command := "sync"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	var err error
+	switch command {
+	case "sync":
+		err = run(conf)
+	case "status":
+		err = status(conf)
+	case "migrate":
+		err = migrate(conf, os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\nUsage: %s [sync|status|migrate]\n", command, os.Args[0])
+		os.Exit(exitFailure)
+	}
+	switch {
+	case metrics.ErrInterrupted.Is(err):
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitInterrupted)
+	case err != nil:
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(2)
+		os.Exit(exitFailure)
 	}
 }
 
+const (
+	// exitFailure is the exit code used when the command failed.
+	exitFailure = 2
+	// exitInterrupted is the exit code used when the command was stopped
+	// by a signal.
+	exitInterrupted = 3
+)
+
 func env(name, fallback string) string {
 	if v, ok := os.LookupEnv(name); ok {
 		return v
@@ -29,39 +77,119 @@ func env(name, fallback string) string {
 	return fallback
 }
 
+// envInt returns the value of an environment variable parsed as an integer.
+// The fallback is returned if the variable is not set or is not a number.
+func envInt(name string, fallback int) int {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid %s value %q, using %d\n", name, v, fallback)
+		return fallback
+	}
+	return n
+}
+
+// envDuration returns the value of an environment variable parsed as a
+// duration. The fallback is returned if the variable is not set or is not a
+// valid duration.
+func envDuration(name string, fallback time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid %s value %q, using %s\n", name, v, fallback)
+		return fallback
+	}
+	return d
+}
+
 type configuration struct {
 	PostgresURI     string
 	TendermintWsURI string
+	// RecordDir is the directory that all tendermint responses are
+	// written to. Responses are not recorded if empty.
+	RecordDir string
+	Sync      metrics.SyncConfig
 }
 
 func run(conf configuration) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Cancel the context on termination request so that all resources
+	// can be released before exiting.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	go func() {
+		select {
+		case sig := <-sigc:
+			fmt.Fprintf(os.Stderr, "received %s, shutting down\n", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	db, err := sql.Open("postgres", conf.PostgresURI)
 	if err != nil {
 		return fmt.Errorf("cannot connect to postgres: %s", err)
 	}
 	defer db.Close()
 
-	if err := metrics.EnsureSchema(db); err != nil {
-		return fmt.Errorf("ensure schema: %s", err)
+	if _, err := metrics.MigrateUp(ctx, db, metrics.LatestSchemaVersion()); err != nil {
+		return errors.Wrap(err, "migrate schema")
 	}
 
 	st := metrics.NewStore(db)
 
-	tmc, err := metrics.DialTendermint(conf.TendermintWsURI)
+	tmc, err := connectTendermint(conf.TendermintWsURI)
 	if err != nil {
-		return errors.Wrap(err, "dial tendermint")
+		return errors.Wrap(err, "connect tendermint")
 	}
 	defer tmc.Close()
 
-	inserted, err := metrics.Sync(ctx, tmc, st)
-	if err != nil {
-		return errors.Wrap(err, "sync")
+	if conf.RecordDir != "" {
+		rec, ok := tmc.(interface{ Record(*metrics.Recorder) })
+		if !ok {
+			return fmt.Errorf("%s does not support recording", conf.TendermintWsURI)
+		}
+		r, err := metrics.NewRecorder(conf.RecordDir)
+		if err != nil {
+			return errors.Wrap(err, "recorder")
+		}
+		rec.Record(r)
 	}
 
+	var inserted uint
+	// Subscriptions are available only over websocket. Otherwise poll
+	// for new blocks.
+	if wsc, ok := tmc.(*metrics.TendermintClient); ok {
+		inserted, err = metrics.StreamSync(ctx, wsc, st, conf.Sync)
+	} else {
+		inserted, err = metrics.Sync(ctx, tmc, st, conf.Sync)
+	}
 	fmt.Println("inserted:", inserted)
-
+	if err != nil {
+		return errors.Wrap(err, "sync")
+	}
 	return nil
 }
+
+// connectTendermint returns a client for given comma separated list of
+// tendermint URIs. If more than one URI is given, calls are spread between
+// all nodes.
+func connectTendermint(uris string) (metrics.TendermintRPC, error) {
+	list := strings.Split(uris, ",")
+	for i, uri := range list {
+		list[i] = strings.TrimSpace(uri)
+	}
+	if len(list) == 1 {
+		return metrics.ConnectTendermint(list[0])
+	}
+	return metrics.NewTendermintPool(list)
+}
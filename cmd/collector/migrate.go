@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/iov-one/block-metrics/pkg/errors"
+	"github.com/iov-one/block-metrics/pkg/metrics"
+)
+
+const migrateUsage = `Usage: %s migrate [status|up [version]|down [version]]
+
+  status          list all migrations and when they were applied
+  up [version]    apply migrations up to given version, all by default
+  down [version]  revert migrations above given version, the most recent
+                  one by default
+`
+
+// migrate manages the database schema version. Status is printed if no
+// subcommand is given.
+func migrate(conf configuration, args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	subcommand := "status"
+	if len(args) > 0 {
+		subcommand = args[0]
+		args = args[1:]
+	}
+	if len(args) > 1 {
+		fmt.Fprintf(os.Stderr, migrateUsage, os.Args[0])
+		os.Exit(exitFailure)
+	}
+
+	db, err := sql.Open("postgres", conf.PostgresURI)
+	if err != nil {
+		return fmt.Errorf("cannot connect to postgres: %s", err)
+	}
+	defer db.Close()
+
+	status, err := metrics.SchemaStatus(ctx, db)
+	if err != nil {
+		return errors.Wrap(err, "schema status")
+	}
+	var current int
+	for _, s := range status {
+		if s.AppliedAt != nil {
+			current = s.Version
+		}
+	}
+
+	switch subcommand {
+	case "status":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, s := range status {
+			applied := "-"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return w.Flush()
+	case "up":
+		version := metrics.LatestSchemaVersion()
+		if len(args) == 1 {
+			if version, err = strconv.Atoi(args[0]); err != nil {
+				return fmt.Errorf("invalid version %q", args[0])
+			}
+		}
+		n, err := metrics.MigrateUp(ctx, db, version)
+		fmt.Println("applied:", n)
+		if err != nil {
+			return errors.Wrap(err, "migrate up")
+		}
+		return nil
+	case "down":
+		version := current - 1
+		if len(args) == 1 {
+			if version, err = strconv.Atoi(args[0]); err != nil {
+				return fmt.Errorf("invalid version %q", args[0])
+			}
+		}
+		if version < 0 {
+			fmt.Println("no migration applied")
+			return nil
+		}
+		n, err := metrics.MigrateDown(ctx, db, version)
+		fmt.Println("reverted:", n)
+		if err != nil {
+			return errors.Wrap(err, "migrate down")
+		}
+		return nil
+	default:
+		fmt.Fprintf(os.Stderr, migrateUsage, os.Args[0])
+		os.Exit(exitFailure)
+		return nil
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/iov-one/block-metrics/pkg/errors"
+	"github.com/iov-one/block-metrics/pkg/metrics"
+)
+
+// status prints the progress of the synchronization as recorded in the
+// database.
+func status(conf configuration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	db, err := sql.Open("postgres", conf.PostgresURI)
+	if err != nil {
+		return fmt.Errorf("cannot connect to postgres: %s", err)
+	}
+	defer db.Close()
+
+	state, err := metrics.NewStore(db).LoadSyncState(ctx)
+	switch {
+	case metrics.ErrNotFound.Is(err):
+		fmt.Println("synchronization was never run")
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "load sync state")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "node:\t%s\n", state.NodeURI)
+	fmt.Fprintf(w, "synced height:\t%d\n", state.SyncedHeight)
+	fmt.Fprintf(w, "chain height:\t%d\n", state.ChainHeight)
+	if state.ChainHeight > state.SyncedHeight {
+		fmt.Fprintf(w, "behind:\t%d blocks\n", state.ChainHeight-state.SyncedHeight)
+	}
+	fmt.Fprintf(w, "started at:\t%s\n", state.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "updated at:\t%s\n", state.UpdatedAt.Format(time.RFC3339))
+	if state.StoppedAt == nil {
+		fmt.Fprintf(w, "stopped at:\t-\n")
+	} else {
+		fmt.Fprintf(w, "stopped at:\t%s\n", state.StoppedAt.Format(time.RFC3339))
+	}
+	if state.LastError != "" {
+		fmt.Fprintf(w, "last error:\t%s\n", state.LastError)
+	}
+	return w.Flush()
+}
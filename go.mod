@@ -1,12 +1,8 @@
 module github.com/iov-one/block-metrics
 
 require (
-	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gorilla/mux v1.7.3
 	github.com/gorilla/websocket v1.4.0
 	github.com/iov-one/weave v0.21.0
-	github.com/jinzhu/gorm v1.9.11
-	github.com/joho/godotenv v1.3.0
 	github.com/lib/pq v1.1.1
-	golang.org/x/crypto v0.0.0-20190513172903-22d7a77e9e5f
 )
@@ -1,30 +1,36 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"net/http"
 	"os"
 
-	"github.com/gorilla/mux"
-	"github.com/iov-one/block-metrics/controllers"
+	"github.com/iov-one/block-metrics/pkg/api"
+	"github.com/iov-one/block-metrics/pkg/metrics"
 )
 
 func main() {
-
-	router := mux.NewRouter()
-
-	router.HandleFunc("/api/blocks/{id:[0-9]+}", controllers.GetBlocksFor).Methods("GET")
-	// router.NotFoundHandler = app.NotFoundHandler
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3000" //localhost
+	db, err := sql.Open("postgres", env("POSTGRES_URI", "user=postgres dbname=postgres"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot connect to postgres: %s\n", err)
+		os.Exit(2)
 	}
+	defer db.Close()
+
+	port := env("PORT", "3000") //localhost
 
 	fmt.Println("port", port)
 
-	err := http.ListenAndServe(":"+port, router) //Launch the app, visit localhost:3000/api
+	err = http.ListenAndServe(":"+port, api.NewHandler(metrics.NewStore(db), api.Config{Bech32Prefix: env("BECH32_PREFIX", "iov")})) //Launch the app, visit localhost:3000/api
 	if err != nil {
 		fmt.Print(err)
 	}
 }
+
+func env(name, fallback string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return fallback
+}
@@ -1,41 +0,0 @@
-package models
-
-import (
-	"fmt"
-	"os"
-
-	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/postgres"
-	"github.com/joho/godotenv"
-)
-
-var db *gorm.DB
-
-func init() {
-
-	e := godotenv.Load()
-	if e != nil {
-		fmt.Print(e)
-	}
-
-	username := os.Getenv("db_user")
-	password := os.Getenv("db_pass")
-	dbName := os.Getenv("db_name")
-	dbHost := os.Getenv("db_host")
-
-	dbUri := fmt.Sprintf("host=%s user=%s dbname=%s sslmode=disable password=%s", dbHost, username, dbName, password)
-	fmt.Println(dbUri)
-
-	conn, err := gorm.Open("postgres", dbUri)
-	if err != nil {
-		fmt.Print(err)
-	}
-
-	db = conn
-	db.Debug()
-	// db.Debug().AutoMigrate(&Transaction{}, &Block{})
-}
-
-func GetDB() *gorm.DB {
-	return db
-}
@@ -0,0 +1,144 @@
+// Package api implements the REST API serving the blocks collected by the
+// metrics package.
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/iov-one/block-metrics/pkg/errors"
+	"github.com/iov-one/block-metrics/pkg/metrics"
+)
+
+// Config configures the API. Zero value fields are replaced with defaults.
+type Config struct {
+	// Bech32Prefix is the human readable part of bech32 encoded
+	// addresses. Default is "iov".
+	Bech32Prefix string
+}
+
+// NewHandler returns the HTTP handler of all API endpoints, backed by given
+// store.
+func NewHandler(st metrics.BlockStore, conf Config) http.Handler {
+	if conf.Bech32Prefix == "" {
+		conf.Bech32Prefix = "iov"
+	}
+	h := &handler{st: st, conf: conf}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/blocks/{height:[0-9]+}", h.block).Methods("GET")
+	r.HandleFunc("/api/validators", h.validators).Methods("GET")
+	r.HandleFunc("/api/validators/{address}", h.validator).Methods("GET")
+	r.HandleFunc("/api/validators/{address}/uptime", h.validatorUptime).Methods("GET")
+	r.HandleFunc("/api/validators/{address}/missed", h.validatorMissed).Methods("GET")
+	r.HandleFunc("/api/tx", h.transactions).Methods("GET")
+	r.HandleFunc("/api/tx/{hash}", h.transaction).Methods("GET")
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondError(w, http.StatusNotFound, "this resource was not found on our server")
+	})
+	return r
+}
+
+type handler struct {
+	st   metrics.BlockStore
+	conf Config
+}
+
+// response is the envelope of all API responses.
+type response struct {
+	Status  bool        `json:"status"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// respond writes given data as a successful response.
+func respond(w http.ResponseWriter, data interface{}) {
+	writeJSON(w, http.StatusOK, response{Status: true, Message: "success", Data: data})
+}
+
+// respondError writes a failed response with given status code.
+func respondError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, response{Status: false, Message: message})
+}
+
+// respondStoreError writes a failed response for an error returned by the
+// store. Errors that are not caused by the request are logged and not
+// disclosed.
+func respondStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case metrics.ErrNotFound.Is(err):
+		respondError(w, http.StatusNotFound, err.Error())
+	case metrics.ErrInvalid.Is(err):
+		respondError(w, http.StatusBadRequest, err.Error())
+	default:
+		log.Printf("api: %s", err)
+		respondError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		log.Printf("api: cannot write response: %s", err)
+	}
+}
+
+// page returns the page requested with the cursor and limit query
+// parameters.
+func page(r *http.Request) (metrics.Page, error) {
+	q := r.URL.Query()
+	p := metrics.Page{Cursor: q.Get("cursor")}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return p, errors.Wrapf(metrics.ErrInvalid, "limit %q", v)
+		}
+		p.Limit = limit
+	}
+	return p, nil
+}
+
+// heightParam returns the value of the height query parameter with given
+// name, or zero if not set.
+func heightParam(r *http.Request, name string) (int64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	h, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || h <= 0 {
+		return 0, errors.Wrapf(metrics.ErrInvalid, "%s %q", name, v)
+	}
+	return h, nil
+}
+
+// pageJSON is a part of a query result. Use the next cursor to request the
+// next part. It is empty if there are no more results.
+type pageJSON struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor"`
+}
+
+// hexBytes is a binary value that is JSON encoded as an upper case hex
+// string, same as tendermint does.
+type hexBytes []byte
+
+func (b hexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strings.ToUpper(hex.EncodeToString(b)))
+}
+
+// rawJSON returns given string as a raw JSON value. Values that are not a
+// valid JSON are encoded as a string.
+func rawJSON(s string) json.RawMessage {
+	if json.Valid([]byte(s)) {
+		return json.RawMessage(s)
+	}
+	raw, _ := json.Marshal(s)
+	return raw
+}
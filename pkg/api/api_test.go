@@ -0,0 +1,559 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iov-one/block-metrics/pkg/metrics"
+	"github.com/iov-one/weave/coin"
+)
+
+func TestBlock(t *testing.T) {
+	st := newTestStore(t)
+	srv := httptest.NewServer(NewHandler(st, Config{}))
+	defer srv.Close()
+
+	cases := map[string]struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		"block with transactions": {
+			path:     "/api/blocks/2",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"height": 2,
+					"hash": "0102",
+					"time": "2019-05-01T12:00:05Z",
+					"proposer": {"id": 2, "address": "02"},
+					"participants": [{"id": 1, "address": "01"}, {"id": 2, "address": "02"}],
+					"missed": [{"id": 3, "address": "03"}],
+					"nil_votes": [],
+					"messages": ["cash/send", "cash/send"],
+					"fee_frac": 1500000000,
+					"fees": [{"ticker": "IOV", "whole": 1, "fractional": 500000000}],
+					"transactions": [
+						{
+							"hash": "AA",
+							"message": {"source": "01"},
+							"fee": {"ticker": "IOV", "whole": 1, "fractional": 500000000},
+							"messages": [{"path": "cash/send", "details": {"source": "01"}}]
+						},
+						{
+							"hash": "BB",
+							"message": {"source": "02"},
+							"fee": null,
+							"messages": [{"path": "cash/send", "details": {"source": "02"}}]
+						}
+					]
+				}
+			}`,
+		},
+		"block without transactions": {
+			path:     "/api/blocks/1",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"height": 1,
+					"hash": "0101",
+					"time": "2019-05-01T12:00:00Z",
+					"proposer": {"id": 1, "address": "01"},
+					"participants": [{"id": 1, "address": "01"}, {"id": 2, "address": "02"}, {"id": 3, "address": "03"}],
+					"missed": [],
+					"nil_votes": [],
+					"messages": [],
+					"fee_frac": 0,
+					"fees": [],
+					"transactions": []
+				}
+			}`,
+		},
+		"unknown block": {
+			path:     "/api/blocks/3",
+			wantCode: http.StatusNotFound,
+			wantBody: `{"status": false, "message": "block 3: no blocks: not found"}`,
+		},
+		"invalid height": {
+			path:     "/api/blocks/0",
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"status": false, "message": "invalid block height"}`,
+		},
+		"unknown path": {
+			path:     "/api/unknown",
+			wantCode: http.StatusNotFound,
+			wantBody: `{"status": false, "message": "this resource was not found on our server"}`,
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			assertResponse(t, srv.URL+tc.path, tc.wantCode, tc.wantBody)
+		})
+	}
+}
+
+func TestValidators(t *testing.T) {
+	st := newTestStore(t)
+	// Third validator signs the third block, votes nil for the fourth and
+	// misses the next two. It is not in the validator set of the seventh
+	// block and misses the last one.
+	blockTime := time.Date(2019, 5, 1, 12, 0, 10, 0, time.UTC)
+	blocks := []metrics.Block{
+		{Height: 3, Hash: []byte{0x01, 0x03}, Time: blockTime, ProposerID: 1, ParticipantIDs: []int64{1, 2, 3}},
+		{Height: 4, Hash: []byte{0x01, 0x04}, Time: blockTime.Add(5 * time.Second), ProposerID: 1, ParticipantIDs: []int64{1, 2}, NilVoteIDs: []int64{3}},
+		{Height: 5, Hash: []byte{0x01, 0x05}, Time: blockTime.Add(10 * time.Second), ProposerID: 2, ParticipantIDs: []int64{1, 2}, MissingIDs: []int64{3}},
+		{Height: 6, Hash: []byte{0x01, 0x06}, Time: blockTime.Add(15 * time.Second), ProposerID: 1, ParticipantIDs: []int64{1, 2}, MissingIDs: []int64{3}},
+		{Height: 7, Hash: []byte{0x01, 0x07}, Time: blockTime.Add(20 * time.Second), ProposerID: 2, ParticipantIDs: []int64{1, 2}},
+		{Height: 8, Hash: []byte{0x01, 0x08}, Time: blockTime.Add(25 * time.Second), ProposerID: 1, ParticipantIDs: []int64{1, 2}, MissingIDs: []int64{3}},
+	}
+	if err := st.InsertBlocks(context.Background(), blocks); err != nil {
+		t.Fatalf("cannot insert blocks: %s", err)
+	}
+
+	srv := httptest.NewServer(NewHandler(st, Config{}))
+	defer srv.Close()
+
+	cases := map[string]struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		"first page of validators": {
+			path:     "/api/validators?limit=2&from=2&to=5",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"items": [
+						{
+							"id": 1, "address": "01", "bech32_address": "iov1qyd00w9r", "public_key": "FF01",
+							"signed": 4, "missed": 0, "nil_votes": 0, "blocks": 4, "uptime": 100
+						},
+						{
+							"id": 2, "address": "02", "bech32_address": "iov1qgu3fy5y", "public_key": "FF02",
+							"signed": 4, "missed": 0, "nil_votes": 0, "blocks": 4, "uptime": 100
+						}
+					],
+					"next_cursor": "2"
+				}
+			}`,
+		},
+		"last page of validators": {
+			path:     "/api/validators?limit=2&from=2&to=5&cursor=2",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"items": [
+						{
+							"id": 3, "address": "03", "bech32_address": "iov1qvnmtzm7", "public_key": "FF03",
+							"signed": 1, "missed": 2, "nil_votes": 1, "blocks": 4, "uptime": 25
+						}
+					],
+					"next_cursor": ""
+				}
+			}`,
+		},
+		"validators without blocks": {
+			path:     "/api/validators?from=9&limit=1",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"items": [
+						{
+							"id": 1, "address": "01", "bech32_address": "iov1qyd00w9r", "public_key": "FF01",
+							"signed": 0, "missed": 0, "nil_votes": 0, "blocks": 0, "uptime": null
+						}
+					],
+					"next_cursor": "1"
+				}
+			}`,
+		},
+		"invalid limit": {
+			path:     "/api/validators?limit=x",
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"status": false, "message": "limit \"x\": invalid"}`,
+		},
+		"invalid height": {
+			path:     "/api/validators?from=-1",
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"status": false, "message": "from \"-1\": invalid"}`,
+		},
+		"validator by hex address": {
+			path:     "/api/validators/03",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"id": 3, "address": "03", "bech32_address": "iov1qvnmtzm7", "public_key": "FF03",
+					"signed": 2, "missed": 4, "nil_votes": 1, "blocks": 7, "uptime": 28.571428571428573
+				}
+			}`,
+		},
+		"validator by bech32 address": {
+			path:     "/api/validators/iov1qvnmtzm7?to=1",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"id": 3, "address": "03", "bech32_address": "iov1qvnmtzm7", "public_key": "FF03",
+					"signed": 1, "missed": 0, "nil_votes": 0, "blocks": 1, "uptime": 100
+				}
+			}`,
+		},
+		"unknown validator": {
+			path:     "/api/validators/04",
+			wantCode: http.StatusNotFound,
+			wantBody: `{"status": false, "message": "validator 04: not found"}`,
+		},
+		"invalid address": {
+			path:     "/api/validators/xyz",
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"status": false, "message": "address \"xyz\": invalid"}`,
+		},
+		"invalid address prefix": {
+			path:     "/api/validators/tiov1qypg9tjv",
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"status": false, "message": "address prefix \"tiov\": invalid"}`,
+		},
+		"uptime": {
+			path:     "/api/validators/03/uptime",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"id": 3, "address": "03", "bech32_address": "iov1qvnmtzm7", "public_key": "FF03",
+					"signed": 2, "missed": 4, "nil_votes": 1, "blocks": 7, "uptime": 28.571428571428573,
+					"from_height": 1, "to_height": 8,
+					"longest_signed": {"status": "signed", "length": 1, "from_height": 3, "to_height": 3},
+					"longest_missed": {"status": "missed", "length": 2, "from_height": 5, "to_height": 6},
+					"current": {"status": "missed", "length": 1, "from_height": 8, "to_height": 8}
+				}
+			}`,
+		},
+		"uptime of a range": {
+			path:     "/api/validators/01/uptime?from=2&to=4",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"id": 1, "address": "01", "bech32_address": "iov1qyd00w9r", "public_key": "FF01",
+					"signed": 3, "missed": 0, "nil_votes": 0, "blocks": 3, "uptime": 100,
+					"from_height": 2, "to_height": 4,
+					"longest_signed": {"status": "signed", "length": 3, "from_height": 2, "to_height": 4},
+					"longest_missed": null,
+					"current": {"status": "signed", "length": 3, "from_height": 2, "to_height": 4}
+				}
+			}`,
+		},
+		"uptime of a too long range": {
+			path:     "/api/validators/03/uptime?from=1&to=10001",
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"status": false, "message": "range 1-10001 longer than 10000 blocks: invalid"}`,
+		},
+		"first page of missed blocks": {
+			path:     "/api/validators/03/missed?limit=2",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"items": [
+						{"height": 8, "time": "2019-05-01T12:00:35Z", "proposer": {"id": 1, "address": "01"}},
+						{"height": 6, "time": "2019-05-01T12:00:25Z", "proposer": {"id": 1, "address": "01"}}
+					],
+					"next_cursor": "6"
+				}
+			}`,
+		},
+		"last page of missed blocks": {
+			path:     "/api/validators/03/missed?limit=2&cursor=6",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"items": [
+						{"height": 5, "time": "2019-05-01T12:00:20Z", "proposer": {"id": 2, "address": "02"}},
+						{"height": 2, "time": "2019-05-01T12:00:05Z", "proposer": {"id": 2, "address": "02"}}
+					],
+					"next_cursor": ""
+				}
+			}`,
+		},
+		"missed blocks of a range": {
+			path:     "/api/validators/03/missed?to=4",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"items": [
+						{"height": 2, "time": "2019-05-01T12:00:05Z", "proposer": {"id": 2, "address": "02"}}
+					],
+					"next_cursor": ""
+				}
+			}`,
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			assertResponse(t, srv.URL+tc.path, tc.wantCode, tc.wantBody)
+		})
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	st := newTestStore(t)
+	block := metrics.Block{
+		Height:         3,
+		Hash:           []byte{0x01, 0x03},
+		Time:           time.Date(2019, 5, 1, 12, 0, 10, 0, time.UTC),
+		ProposerID:     3,
+		ParticipantIDs: []int64{1, 2, 3},
+		Messages:       []string{"username/register"},
+		Transactions: []metrics.Transaction{
+			{
+				Hash:     []byte{0xCC},
+				Message:  `{"username":"alice*iov"}`,
+				Messages: []metrics.Message{{Path: "username/register", Details: `{"username":"alice*iov"}`}},
+			},
+		},
+	}
+	if err := st.InsertBlocks(context.Background(), []metrics.Block{block}); err != nil {
+		t.Fatalf("cannot insert block: %s", err)
+	}
+
+	srv := httptest.NewServer(NewHandler(st, Config{}))
+	defer srv.Close()
+
+	cases := map[string]struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		"transaction with fee": {
+			path:     "/api/tx/aa",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"hash": "AA",
+					"message": {"source": "01"},
+					"fee": {"ticker": "IOV", "whole": 1, "fractional": 500000000},
+					"messages": [{"path": "cash/send", "details": {"source": "01"}}],
+					"block": {"height": 2, "hash": "0102", "time": "2019-05-01T12:00:05Z", "proposer": {"id": 2, "address": "02"}}
+				}
+			}`,
+		},
+		"transaction without fee": {
+			path:     "/api/tx/CC",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"hash": "CC",
+					"message": {"username": "alice*iov"},
+					"fee": null,
+					"messages": [{"path": "username/register", "details": {"username": "alice*iov"}}],
+					"block": {"height": 3, "hash": "0103", "time": "2019-05-01T12:00:10Z", "proposer": {"id": 3, "address": "03"}}
+				}
+			}`,
+		},
+		"unknown transaction": {
+			path:     "/api/tx/DD",
+			wantCode: http.StatusNotFound,
+			wantBody: `{"status": false, "message": "transaction DD: not found"}`,
+		},
+		"invalid hash": {
+			path:     "/api/tx/xyz",
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"status": false, "message": "invalid transaction hash"}`,
+		},
+		"first page of transactions by path": {
+			path:     "/api/tx?path=cash/send&limit=1",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"items": [
+						{
+							"hash": "BB",
+							"message": {"source": "02"},
+							"fee": null,
+							"messages": [{"path": "cash/send", "details": {"source": "02"}}],
+							"block_height": 2
+						}
+					],
+					"next_cursor": "2"
+				}
+			}`,
+		},
+		"last page of transactions by path": {
+			path:     "/api/tx?path=cash/send&limit=1&cursor=2",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"items": [
+						{
+							"hash": "AA",
+							"message": {"source": "01"},
+							"fee": {"ticker": "IOV", "whole": 1, "fractional": 500000000},
+							"messages": [{"path": "cash/send", "details": {"source": "01"}}],
+							"block_height": 2
+						}
+					],
+					"next_cursor": ""
+				}
+			}`,
+		},
+		"transactions of a height range": {
+			path:     "/api/tx?from_height=3&to_height=3",
+			wantCode: http.StatusOK,
+			wantBody: `{
+				"status": true,
+				"message": "success",
+				"data": {
+					"items": [
+						{
+							"hash": "CC",
+							"message": {"username": "alice*iov"},
+							"fee": null,
+							"messages": [{"path": "username/register", "details": {"username": "alice*iov"}}],
+							"block_height": 3
+						}
+					],
+					"next_cursor": ""
+				}
+			}`,
+		},
+		"no matching transactions": {
+			path:     "/api/tx?path=cash/send&from_height=3",
+			wantCode: http.StatusOK,
+			wantBody: `{"status": true, "message": "success", "data": {"items": [], "next_cursor": ""}}`,
+		},
+		"invalid height": {
+			path:     "/api/tx?to_height=x",
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"status": false, "message": "to_height \"x\": invalid"}`,
+		},
+		"invalid cursor": {
+			path:     "/api/tx?cursor=x",
+			wantCode: http.StatusBadRequest,
+			wantBody: `{"status": false, "message": "transactions: cursor \"x\": invalid"}`,
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			assertResponse(t, srv.URL+tc.path, tc.wantCode, tc.wantBody)
+		})
+	}
+}
+
+// assertResponse fails the test if the GET request to given URL does not
+// respond with given status code and JSON body.
+func assertResponse(t *testing.T, url string, wantCode int, wantBody string) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("cannot get %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != wantCode {
+		t.Errorf("want status %d, got %d", wantCode, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	var got, want interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("cannot decode response: %s", err)
+	}
+	if err := json.Unmarshal([]byte(wantBody), &want); err != nil {
+		t.Fatalf("cannot decode expected body: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.MarshalIndent(got, "", "  ")
+		t.Logf(" got %s", gotJSON)
+		t.Logf("want %s", wantBody)
+		t.Fatal("unexpected response")
+	}
+}
+
+// newTestStore returns a store with three validators and two blocks. Second
+// block is proposed by the second validator, misses the third one and
+// contains two transactions.
+func newTestStore(t *testing.T) metrics.BlockStore {
+	t.Helper()
+	ctx := context.Background()
+	st := metrics.NewMemStore()
+
+	for i := byte(1); i <= 3; i++ {
+		if _, err := st.InsertValidator(ctx, []byte{0xFF, i}, []byte{i}); err != nil {
+			t.Fatalf("cannot insert validator: %s", err)
+		}
+	}
+
+	blockTime := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	blocks := []metrics.Block{
+		{
+			Height:         1,
+			Hash:           []byte{0x01, 0x01},
+			Time:           blockTime,
+			ProposerID:     1,
+			ParticipantIDs: []int64{1, 2, 3},
+		},
+		{
+			Height:         2,
+			Hash:           []byte{0x01, 0x02},
+			Time:           blockTime.Add(5 * time.Second),
+			ProposerID:     2,
+			ParticipantIDs: []int64{1, 2},
+			MissingIDs:     []int64{3},
+			Messages:       []string{"cash/send", "cash/send"},
+			FeeFrac:        1500000000,
+			Fees:           coin.Coins{coin.NewCoinp(1, 500000000, "IOV")},
+			Transactions: []metrics.Transaction{
+				{
+					Hash:     []byte{0xAA},
+					Message:  `{"source":"01"}`,
+					Fee:      coin.NewCoinp(1, 500000000, "IOV"),
+					Messages: []metrics.Message{{Path: "cash/send", Details: `{"source":"01"}`}},
+				},
+				{
+					Hash:     []byte{0xBB},
+					Message:  `{"source":"02"}`,
+					Messages: []metrics.Message{{Path: "cash/send", Details: `{"source":"02"}`}},
+				},
+			},
+		},
+	}
+	if err := st.InsertBlocks(ctx, blocks); err != nil {
+		t.Fatalf("cannot insert blocks: %s", err)
+	}
+	return st
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/iov-one/block-metrics/pkg/errors"
+	"github.com/iov-one/block-metrics/pkg/metrics"
+	"github.com/iov-one/weave/coin"
+)
+
+// block serves the block with the height given in the path.
+func (h *handler) block(w http.ResponseWriter, r *http.Request) {
+	height, err := strconv.ParseInt(mux.Vars(r)["height"], 10, 64)
+	if err != nil || height <= 0 {
+		respondError(w, http.StatusBadRequest, "invalid block height")
+		return
+	}
+
+	ctx := r.Context()
+	b, err := h.st.LoadBlock(ctx, height)
+	if err != nil {
+		respondStoreError(w, errors.Wrapf(err, "block %d", height))
+		return
+	}
+	txs, err := h.blockTransactions(ctx, height)
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	addresses, err := h.st.ValidatorAddresses(ctx, blockValidatorIDs(b))
+	if err != nil {
+		respondStoreError(w, errors.Wrap(err, "validator addresses"))
+		return
+	}
+	respond(w, newBlockJSON(b, txs, addresses))
+}
+
+// blockTransactions returns all transactions of the block with given height,
+// in the block order.
+func (h *handler) blockTransactions(ctx context.Context, height int64) ([]*metrics.BlockTransaction, error) {
+	var (
+		txs    []*metrics.BlockTransaction
+		filter = metrics.TransactionFilter{FromHeight: height, ToHeight: height}
+		page   metrics.Page
+	)
+	for {
+		res, next, err := h.st.Transactions(ctx, filter, page)
+		if err != nil {
+			return nil, errors.Wrap(err, "transactions")
+		}
+		txs = append(txs, res...)
+		if next == "" {
+			break
+		}
+		page.Cursor = next
+	}
+	// Most recent transactions are returned first.
+	for i, j := 0, len(txs)-1; i < j; i, j = i+1, j-1 {
+		txs[i], txs[j] = txs[j], txs[i]
+	}
+	return txs, nil
+}
+
+func blockValidatorIDs(b *metrics.Block) []int64 {
+	ids := []int64{b.ProposerID}
+	ids = append(ids, b.ParticipantIDs...)
+	ids = append(ids, b.MissingIDs...)
+	return append(ids, b.NilVoteIDs...)
+}
+
+type blockJSON struct {
+	Height       int64              `json:"height"`
+	Hash         hexBytes           `json:"hash"`
+	Time         time.Time          `json:"time"`
+	Proposer     validatorRefJSON   `json:"proposer"`
+	Participants []validatorRefJSON `json:"participants"`
+	// Missed are the validators that did not vote at all.
+	Missed []validatorRefJSON `json:"missed"`
+	// NilVotes are the validators that voted, but not for this block.
+	NilVotes     []validatorRefJSON `json:"nil_votes"`
+	Messages     []string           `json:"messages"`
+	FeeFrac      uint64             `json:"fee_frac"`
+	Fees         []coinJSON         `json:"fees"`
+	Transactions []transactionJSON  `json:"transactions"`
+}
+
+func newBlockJSON(b *metrics.Block, txs []*metrics.BlockTransaction, addresses map[int64][]byte) blockJSON {
+	res := blockJSON{
+		Height:       b.Height,
+		Hash:         b.Hash,
+		Time:         b.Time,
+		Proposer:     validatorRefJSON{ID: b.ProposerID, Address: addresses[b.ProposerID]},
+		Participants: validatorRefs(b.ParticipantIDs, addresses),
+		Missed:       validatorRefs(b.MissingIDs, addresses),
+		NilVotes:     validatorRefs(b.NilVoteIDs, addresses),
+		Messages:     b.Messages,
+		FeeFrac:      b.FeeFrac,
+		Fees:         make([]coinJSON, 0, len(b.Fees)),
+		Transactions: make([]transactionJSON, 0, len(txs)),
+	}
+	// Avoid null in the JSON.
+	if res.Messages == nil {
+		res.Messages = []string{}
+	}
+	for _, fee := range b.Fees {
+		res.Fees = append(res.Fees, newCoinJSON(fee))
+	}
+	for _, tx := range txs {
+		res.Transactions = append(res.Transactions, newTransactionJSON(tx))
+	}
+	return res
+}
+
+// validatorRefJSON identifies a validator.
+type validatorRefJSON struct {
+	ID      int64    `json:"id"`
+	Address hexBytes `json:"address"`
+}
+
+func validatorRefs(ids []int64, addresses map[int64][]byte) []validatorRefJSON {
+	refs := make([]validatorRefJSON, 0, len(ids))
+	for _, id := range ids {
+		refs = append(refs, validatorRefJSON{ID: id, Address: addresses[id]})
+	}
+	return refs
+}
+
+type coinJSON struct {
+	Ticker     string `json:"ticker"`
+	Whole      int64  `json:"whole"`
+	Fractional int64  `json:"fractional"`
+}
+
+func newCoinJSON(c *coin.Coin) coinJSON {
+	return coinJSON{Ticker: c.Ticker, Whole: c.Whole, Fractional: c.Fractional}
+}
+
+type transactionJSON struct {
+	Hash    hexBytes        `json:"hash"`
+	Message json.RawMessage `json:"message"`
+	// Fee is null if no fee was paid.
+	Fee      *coinJSON     `json:"fee"`
+	Messages []messageJSON `json:"messages"`
+}
+
+func newTransactionJSON(tx *metrics.BlockTransaction) transactionJSON {
+	res := transactionJSON{
+		Hash:     tx.Hash,
+		Message:  rawJSON(tx.Message),
+		Messages: make([]messageJSON, 0, len(tx.Messages)),
+	}
+	if tx.Fee != nil {
+		fee := newCoinJSON(tx.Fee)
+		res.Fee = &fee
+	}
+	for _, m := range tx.Messages {
+		res.Messages = append(res.Messages, messageJSON{Path: m.Path, Details: rawJSON(m.Details)})
+	}
+	return res
+}
+
+type messageJSON struct {
+	Path    string          `json:"path"`
+	Details json.RawMessage `json:"details"`
+}
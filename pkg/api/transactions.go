@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/iov-one/block-metrics/pkg/errors"
+	"github.com/iov-one/block-metrics/pkg/metrics"
+)
+
+// transaction serves the transaction with the hash given in the path,
+// together with the block that contains it.
+func (h *handler) transaction(w http.ResponseWriter, r *http.Request) {
+	hash, err := hex.DecodeString(mux.Vars(r)["hash"])
+	if err != nil || len(hash) == 0 {
+		respondError(w, http.StatusBadRequest, "invalid transaction hash")
+		return
+	}
+
+	ctx := r.Context()
+	filter := metrics.TransactionFilter{Hash: hash}
+	txs, _, err := h.st.Transactions(ctx, filter, metrics.Page{Limit: 1})
+	if err != nil {
+		respondStoreError(w, errors.Wrap(err, "transactions"))
+		return
+	}
+	if len(txs) == 0 {
+		respondStoreError(w, errors.Wrapf(metrics.ErrNotFound, "transaction %X", hash))
+		return
+	}
+	tx := txs[0]
+	b, err := h.st.LoadBlock(ctx, tx.BlockHeight)
+	if err != nil {
+		respondStoreError(w, errors.Wrapf(err, "block %d", tx.BlockHeight))
+		return
+	}
+	addresses, err := h.st.ValidatorAddresses(ctx, []int64{b.ProposerID})
+	if err != nil {
+		respondStoreError(w, errors.Wrap(err, "validator addresses"))
+		return
+	}
+	respond(w, transactionDetailJSON{
+		transactionJSON: newTransactionJSON(tx),
+		Block: blockRefJSON{
+			Height:   b.Height,
+			Hash:     b.Hash,
+			Time:     b.Time,
+			Proposer: validatorRefJSON{ID: b.ProposerID, Address: addresses[b.ProposerID]},
+		},
+	})
+}
+
+// transactions serves the transactions containing a message with the path
+// given in the query, most recent first.
+func (h *handler) transactions(w http.ResponseWriter, r *http.Request) {
+	filter := metrics.TransactionFilter{MessagePath: r.URL.Query().Get("path")}
+	var err error
+	if filter.FromHeight, err = heightParam(r, "from_height"); err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	if filter.ToHeight, err = heightParam(r, "to_height"); err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	p, err := page(r)
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	txs, next, err := h.st.Transactions(r.Context(), filter, p)
+	if err != nil {
+		respondStoreError(w, errors.Wrap(err, "transactions"))
+		return
+	}
+	items := make([]blockTransactionJSON, 0, len(txs))
+	for _, tx := range txs {
+		items = append(items, blockTransactionJSON{
+			transactionJSON: newTransactionJSON(tx),
+			BlockHeight:     tx.BlockHeight,
+		})
+	}
+	respond(w, pageJSON{Items: items, NextCursor: next})
+}
+
+type transactionDetailJSON struct {
+	transactionJSON
+	Block blockRefJSON `json:"block"`
+}
+
+// blockRefJSON identifies a block.
+type blockRefJSON struct {
+	Height   int64            `json:"height"`
+	Hash     hexBytes         `json:"hash"`
+	Time     time.Time        `json:"time"`
+	Proposer validatorRefJSON `json:"proposer"`
+}
+
+type blockTransactionJSON struct {
+	transactionJSON
+	BlockHeight int64 `json:"block_height"`
+}
@@ -0,0 +1,341 @@
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/iov-one/block-metrics/pkg/errors"
+	"github.com/iov-one/block-metrics/pkg/metrics"
+	"github.com/iov-one/weave/crypto/bech32"
+)
+
+// validators serves the validators together with their participation in
+// the blocks between the from and to heights.
+func (h *handler) validators(w http.ResponseWriter, r *http.Request) {
+	filter, err := validatorFilter(r)
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	p, err := page(r)
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	vals, next, err := h.st.Validators(r.Context(), filter, p)
+	if err != nil {
+		respondStoreError(w, errors.Wrap(err, "validators"))
+		return
+	}
+	items := make([]validatorJSON, 0, len(vals))
+	for _, v := range vals {
+		items = append(items, h.newValidatorJSON(v))
+	}
+	respond(w, pageJSON{Items: items, NextCursor: next})
+}
+
+// validator serves a single validator with the address given in the path.
+func (h *handler) validator(w http.ResponseWriter, r *http.Request) {
+	filter, err := validatorFilter(r)
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	v, ok := h.pathValidator(w, r, filter)
+	if !ok {
+		return
+	}
+	respond(w, h.newValidatorJSON(v))
+}
+
+// maxStreakRange is the maximum number of blocks that streaks are searched
+// for within a single request.
+const maxStreakRange = 10000
+
+// validatorUptime serves the participation of a single validator together
+// with its longest and current streaks. Streaks are searched for within at
+// most maxStreakRange blocks, the most recent ones by default.
+func (h *handler) validatorUptime(w http.ResponseWriter, r *http.Request) {
+	filter, err := validatorFilter(r)
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	ctx := r.Context()
+	if filter, err = h.streakRange(ctx, filter); err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	v, ok := h.pathValidator(w, r, filter)
+	if !ok {
+		return
+	}
+	streaks, err := h.validatorStreaks(ctx, metrics.ParticipationFilter{
+		ValidatorID: v.ID,
+		FromHeight:  filter.FromHeight,
+		ToHeight:    filter.ToHeight,
+	})
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	respond(w, uptimeJSON{
+		validatorJSON: h.newValidatorJSON(v),
+		FromHeight:    filter.FromHeight,
+		ToHeight:      filter.ToHeight,
+		streaks:       streaks,
+	})
+}
+
+// streakRange returns the filter with the range of heights that streaks are
+// searched for. Missing heights default to the most recent blocks. A range
+// longer than maxStreakRange is rejected.
+func (h *handler) streakRange(ctx context.Context, f metrics.ValidatorFilter) (metrics.ValidatorFilter, error) {
+	if f.ToHeight == 0 {
+		switch b, err := h.st.LatestBlock(ctx); {
+		case metrics.ErrNotFound.Is(err):
+			// No blocks, so there is nothing to search.
+			return f, nil
+		case err != nil:
+			return f, errors.Wrap(err, "latest block")
+		default:
+			f.ToHeight = b.Height
+		}
+	}
+	if f.FromHeight == 0 {
+		f.FromHeight = f.ToHeight - maxStreakRange + 1
+		if f.FromHeight < 1 {
+			f.FromHeight = 1
+		}
+	}
+	if f.ToHeight-f.FromHeight >= maxStreakRange {
+		return f, errors.Wrapf(metrics.ErrInvalid, "range %d-%d longer than %d blocks", f.FromHeight, f.ToHeight, maxStreakRange)
+	}
+	return f, nil
+}
+
+// validatorMissed serves the blocks between the from and to heights that a
+// single validator did not vote for, most recent first.
+func (h *handler) validatorMissed(w http.ResponseWriter, r *http.Request) {
+	vf, err := validatorFilter(r)
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	p, err := page(r)
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	v, ok := h.pathValidator(w, r, vf)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	filter := metrics.ParticipationFilter{
+		ValidatorID: v.ID,
+		FromHeight:  vf.FromHeight,
+		ToHeight:    vf.ToHeight,
+		Missed:      true,
+	}
+	parts, next, err := h.st.Participations(ctx, filter, p)
+	if err != nil {
+		respondStoreError(w, errors.Wrap(err, "participations"))
+		return
+	}
+	ids := make([]int64, 0, len(parts))
+	for _, part := range parts {
+		ids = append(ids, part.ProposerID)
+	}
+	addresses, err := h.st.ValidatorAddresses(ctx, ids)
+	if err != nil {
+		respondStoreError(w, errors.Wrap(err, "validator addresses"))
+		return
+	}
+	items := make([]missedBlockJSON, 0, len(parts))
+	for _, part := range parts {
+		items = append(items, missedBlockJSON{
+			Height:   part.BlockHeight,
+			Time:     part.BlockTime,
+			Proposer: validatorRefJSON{ID: part.ProposerID, Address: addresses[part.ProposerID]},
+		})
+	}
+	respond(w, pageJSON{Items: items, NextCursor: next})
+}
+
+// pathValidator loads the validator with the address given in the path,
+// counting its participation in the blocks selected by given filter. If the
+// validator cannot be loaded, an error is written and false returned.
+func (h *handler) pathValidator(w http.ResponseWriter, r *http.Request, filter metrics.ValidatorFilter) (*metrics.ValidatorStats, bool) {
+	address, err := h.parseAddress(mux.Vars(r)["address"])
+	if err != nil {
+		respondStoreError(w, err)
+		return nil, false
+	}
+	filter.Address = address
+	vals, _, err := h.st.Validators(r.Context(), filter, metrics.Page{Limit: 1})
+	if err != nil {
+		respondStoreError(w, errors.Wrap(err, "validators"))
+		return nil, false
+	}
+	if len(vals) == 0 {
+		respondStoreError(w, errors.Wrapf(metrics.ErrNotFound, "validator %X", address))
+		return nil, false
+	}
+	return vals[0], true
+}
+
+// parseAddress decodes a validator address given either as a hex or as a
+// bech32 string.
+func (h *handler) parseAddress(s string) ([]byte, error) {
+	if address, err := hex.DecodeString(s); err == nil {
+		return address, nil
+	}
+	prefix, address, err := bech32.Decode(s)
+	if err != nil {
+		return nil, errors.Wrapf(metrics.ErrInvalid, "address %q", s)
+	}
+	if prefix != h.conf.Bech32Prefix {
+		return nil, errors.Wrapf(metrics.ErrInvalid, "address prefix %q", prefix)
+	}
+	return address, nil
+}
+
+// validatorFilter returns the filter requested with the from and to query
+// parameters.
+func validatorFilter(r *http.Request) (metrics.ValidatorFilter, error) {
+	var (
+		f   metrics.ValidatorFilter
+		err error
+	)
+	if f.FromHeight, err = heightParam(r, "from"); err != nil {
+		return f, err
+	}
+	if f.ToHeight, err = heightParam(r, "to"); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// validatorStreaks pages through all selected participations and returns
+// the longest and the current streaks. A streak is broken by a nil vote and
+// by a block that the validator was not expected to precommit, for example
+// because it was not in the validator set.
+func (h *handler) validatorStreaks(ctx context.Context, filter metrics.ParticipationFilter) (streaks, error) {
+	var (
+		res streaks
+		cur *streakJSON
+		p   = metrics.Page{Limit: 500}
+	)
+	for {
+		parts, next, err := h.st.Participations(ctx, filter, p)
+		if err != nil {
+			return res, errors.Wrap(err, "participations")
+		}
+		// Participations are returned most recent first, so each
+		// streak grows towards the lower heights.
+		for _, part := range parts {
+			status := part.Status.String()
+			if cur != nil && cur.Status == status && cur.FromHeight == part.BlockHeight+1 {
+				cur.Length++
+				cur.FromHeight = part.BlockHeight
+			} else {
+				cur = &streakJSON{Status: status, Length: 1, FromHeight: part.BlockHeight, ToHeight: part.BlockHeight}
+				if res.Current == nil {
+					res.Current = cur
+				}
+			}
+			switch part.Status {
+			case metrics.Signed:
+				res.LongestSigned = longer(res.LongestSigned, cur)
+			case metrics.Missed:
+				res.LongestMissed = longer(res.LongestMissed, cur)
+			}
+		}
+		if next == "" {
+			break
+		}
+		p.Cursor = next
+	}
+	return res, nil
+}
+
+// longer returns the longer of the two streaks. Of equal streaks the most
+// recent one, which was found first, is returned.
+func longer(longest, s *streakJSON) *streakJSON {
+	if longest == nil || s.Length > longest.Length {
+		return s
+	}
+	return longest
+}
+
+type validatorJSON struct {
+	ID            int64    `json:"id"`
+	Address       hexBytes `json:"address"`
+	Bech32Address string   `json:"bech32_address"`
+	PublicKey     hexBytes `json:"public_key"`
+	Signed        int64    `json:"signed"`
+	Missed        int64    `json:"missed"`
+	NilVotes      int64    `json:"nil_votes"`
+	// Blocks is the number of blocks that the validator was expected to
+	// precommit.
+	Blocks int64 `json:"blocks"`
+	// Uptime is the percentage of the blocks that the validator
+	// precommitted. It is null if there are no blocks.
+	Uptime *float64 `json:"uptime"`
+}
+
+func (h *handler) newValidatorJSON(v *metrics.ValidatorStats) validatorJSON {
+	res := validatorJSON{
+		ID:        v.ID,
+		Address:   v.Address,
+		PublicKey: v.PublicKey,
+		Signed:    v.Signed,
+		Missed:    v.Missed,
+		NilVotes:  v.NilVotes,
+		Blocks:    v.Signed + v.Missed + v.NilVotes,
+	}
+	if address, err := bech32.Encode(h.conf.Bech32Prefix, v.Address); err == nil {
+		res.Bech32Address = string(address)
+	}
+	if res.Blocks > 0 {
+		uptime := float64(v.Signed) * 100 / float64(res.Blocks)
+		res.Uptime = &uptime
+	}
+	return res
+}
+
+type uptimeJSON struct {
+	validatorJSON
+	// FromHeight and ToHeight are the range of blocks counted, both
+	// inclusive. They are zero if there are no blocks.
+	FromHeight int64 `json:"from_height"`
+	ToHeight   int64 `json:"to_height"`
+	streaks
+}
+
+// streaks are null if no matching streak was found.
+type streaks struct {
+	LongestSigned *streakJSON `json:"longest_signed"`
+	LongestMissed *streakJSON `json:"longest_missed"`
+	// Current is the streak that includes the most recent block.
+	Current *streakJSON `json:"current"`
+}
+
+// streakJSON is a run of consecutive blocks with the same validator
+// participation status.
+type streakJSON struct {
+	Status     string `json:"status"`
+	Length     int64  `json:"length"`
+	FromHeight int64  `json:"from_height"`
+	ToHeight   int64  `json:"to_height"`
+}
+
+type missedBlockJSON struct {
+	Height   int64            `json:"height"`
+	Time     time.Time        `json:"time"`
+	Proposer validatorRefJSON `json:"proposer"`
+}
@@ -0,0 +1,206 @@
+package metrics
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"time"
+
+	"github.com/iov-one/block-metrics/pkg/errors"
+	bnsd "github.com/iov-one/weave/cmd/bnsd/app"
+)
+
+// Tendermint event types as used in the amino JSON encoding of the event
+// data.
+const (
+	EventNewBlock            = "tendermint/event/NewBlock"
+	EventNewBlockHeader      = "tendermint/event/NewBlockHeader"
+	EventTx                  = "tendermint/event/Tx"
+	EventValidatorSetUpdates = "tendermint/event/ValidatorSetUpdates"
+)
+
+// Event is a single event delivered to a subscription. Depending on the
+// type, one of the typed fields is set. Events of other types are available
+// only in the raw form.
+type Event struct {
+	// Query is the query of the subscription.
+	Query string
+	// Type is the type of the event, for example EventNewBlock.
+	Type string
+	// Raw is the JSON encoded event data.
+	Raw json.RawMessage
+
+	NewBlock            *TendermintBlock
+	NewBlockHeader      *TendermintHeader
+	Tx                  *TendermintTx
+	ValidatorSetUpdates []*ValidatorUpdate
+
+	// Err is set if the event could not be decoded.
+	Err error
+}
+
+// TendermintHeader is the header of a block as delivered with the
+// NewBlockHeader event.
+type TendermintHeader struct {
+	Height          int64
+	Time            time.Time
+	ProposerAddress []byte
+	ValidatorsHash  []byte
+}
+
+// TendermintTx is a transaction as delivered with the Tx event, once it was
+// included in a block.
+type TendermintTx struct {
+	Height int64
+	// Index is the position of the transaction within the block.
+	Index uint32
+	Hash  [32]byte
+	Tx    *bnsd.Tx
+	// Code is the result of the transaction execution. Zero means
+	// success.
+	Code uint32
+	Log  string
+}
+
+// ValidatorUpdate is a change of a validator voting power. Zero power means
+// that the validator was removed from the set.
+type ValidatorUpdate struct {
+	Address     []byte
+	PubKey      []byte
+	VotingPower int64
+}
+
+// decodeEvent returns the event delivered with given response.
+func decodeEvent(query string, resp *jsonrpcResponse) Event {
+	ev := Event{Query: query}
+	if resp.Error != nil {
+		ev.Err = resp.Error.Err()
+		return ev
+	}
+
+	var payload struct {
+		Data struct {
+			Type  string          `json:"type"`
+			Value json.RawMessage `json:"value"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(resp.Result, &payload); err != nil {
+		ev.Err = errors.Wrap(err, "cannot unmarshal event")
+		return ev
+	}
+	ev.Type = payload.Data.Type
+	ev.Raw = payload.Data.Value
+
+	switch ev.Type {
+	case EventNewBlock:
+		var b blockPayload
+		if err := json.Unmarshal(ev.Raw, &b); err != nil {
+			ev.Err = errors.Wrap(err, "cannot unmarshal new block event")
+			return ev
+		}
+		ev.NewBlock, ev.Err = b.block()
+	case EventNewBlockHeader:
+		var h struct {
+			Header struct {
+				Height          sint64    `json:"height"`
+				Time            time.Time `json:"time"`
+				ProposerAddress hexstring `json:"proposer_address"`
+				ValidatorsHash  hexstring `json:"validators_hash"`
+			} `json:"header"`
+		}
+		if err := json.Unmarshal(ev.Raw, &h); err != nil {
+			ev.Err = errors.Wrap(err, "cannot unmarshal new block header event")
+			return ev
+		}
+		ev.NewBlockHeader = &TendermintHeader{
+			Height:          h.Header.Height.Int64(),
+			Time:            h.Header.Time.UTC(),
+			ProposerAddress: h.Header.ProposerAddress,
+			ValidatorsHash:  h.Header.ValidatorsHash,
+		}
+	case EventTx:
+		var t struct {
+			TxResult struct {
+				Height sint64 `json:"height"`
+				Index  uint32 `json:"index"`
+				Tx     []byte `json:"tx"`
+				Result struct {
+					Code uint32 `json:"code"`
+					Log  string `json:"log"`
+				} `json:"result"`
+			} `json:"TxResult"`
+		}
+		if err := json.Unmarshal(ev.Raw, &t); err != nil {
+			ev.Err = errors.Wrap(err, "cannot unmarshal tx event")
+			return ev
+		}
+		var tx bnsd.Tx
+		if err := tx.Unmarshal(t.TxResult.Tx); err != nil {
+			ev.Err = errors.Wrap(err, "cannot unmarshal transaction")
+			return ev
+		}
+		ev.Tx = &TendermintTx{
+			Height: t.TxResult.Height.Int64(),
+			Index:  t.TxResult.Index,
+			Hash:   sha256.Sum256(t.TxResult.Tx),
+			Tx:     &tx,
+			Code:   t.TxResult.Result.Code,
+			Log:    t.TxResult.Result.Log,
+		}
+	case EventValidatorSetUpdates:
+		var v struct {
+			ValidatorUpdates []struct {
+				Address hexstring `json:"address"`
+				PubKey  struct {
+					Value []byte `json:"value"`
+				} `json:"pub_key"`
+				VotingPower sint64 `json:"voting_power"`
+			} `json:"validator_updates"`
+		}
+		if err := json.Unmarshal(ev.Raw, &v); err != nil {
+			ev.Err = errors.Wrap(err, "cannot unmarshal validator set updates event")
+			return ev
+		}
+		for _, u := range v.ValidatorUpdates {
+			ev.ValidatorSetUpdates = append(ev.ValidatorSetUpdates, &ValidatorUpdate{
+				Address:     u.Address,
+				PubKey:      u.PubKey.Value,
+				VotingPower: u.VotingPower.Int64(),
+			})
+		}
+	}
+	return ev
+}
+
+// SubscriptionConfig configures how events are delivered to a subscriber.
+// Zero value fields are replaced with defaults.
+type SubscriptionConfig struct {
+	// Buffer is the number of events that can wait for the subscriber
+	// before the Overflow policy is applied.
+	Buffer int
+	// Overflow defines what happens to an event when the buffer is full.
+	Overflow OverflowPolicy
+}
+
+func (c SubscriptionConfig) withDefaults() SubscriptionConfig {
+	if c.Buffer <= 0 {
+		c.Buffer = 64
+	}
+	return c
+}
+
+// OverflowPolicy defines how events are handled when a subscriber does not
+// consume them fast enough. Events are never allowed to block the connection
+// as that would stall all other requests.
+type OverflowPolicy int
+
+const (
+	// DropNewest discards the event that does not fit into the buffer.
+	DropNewest OverflowPolicy = iota
+	// DropOldest discards the oldest buffered event to make room for
+	// the new one. Use it when only the most recent state matters.
+	DropOldest
+	// CloseOnOverflow unsubscribes and closes the events channel. Use
+	// it when no event can be missed, so that the subscriber notices the
+	// gap and can recover from it.
+	CloseOnOverflow
+)
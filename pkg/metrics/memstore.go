@@ -0,0 +1,560 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/iov-one/block-metrics/pkg/errors"
+)
+
+// NewMemStore returns an empty store that keeps all data in memory.
+func NewMemStore() *MemStore {
+	return &MemStore{
+		blocks:        make(map[int64]*Block),
+		validatorSets: make(map[string][]ValidatorSetMember),
+	}
+}
+
+// MemStore is a BlockStore implementation that keeps all data in memory. It
+// enforces the same constraints as the database does and returns the same
+// errors.
+//
+// MemStore is safe for concurrent use.
+type MemStore struct {
+	mu            sync.RWMutex
+	validators    []memValidator
+	blocks        map[int64]*Block
+	transactions  []memTransaction
+	lastTxID      int64
+	validatorSets map[string][]ValidatorSetMember
+	syncState     *SyncState
+}
+
+type memTransaction struct {
+	id int64
+	BlockTransaction
+}
+
+type memValidator struct {
+	id        int64
+	publicKey []byte
+	address   []byte
+}
+
+// InsertValidator adds a validator and returns its newly created ID. It
+// returns ErrConflict if a validator with the same public key or address
+// exists.
+func (s *MemStore) InsertValidator(ctx context.Context, publicKey, address []byte) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.validators {
+		if bytes.Equal(v.publicKey, publicKey) {
+			return 0, errors.Wrap(ErrConflict, "validator public key exists")
+		}
+		if bytes.Equal(v.address, address) {
+			return 0, errors.Wrap(ErrConflict, "validator address exists")
+		}
+	}
+	// IDs start with one, same as a database sequence.
+	id := int64(len(s.validators) + 1)
+	s.validators = append(s.validators, memValidator{
+		id:        id,
+		publicKey: cloneBytes(publicKey),
+		address:   cloneBytes(address),
+	})
+	return id, nil
+}
+
+// ValidatorAddressID returns an ID of a validator with given address. It
+// returns ErrNotFound if no such validator exists.
+func (s *MemStore) ValidatorAddressID(ctx context.Context, address []byte) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, v := range s.validators {
+		if bytes.Equal(v.address, address) {
+			return v.id, nil
+		}
+	}
+	return 0, errors.Wrapf(ErrNotFound, "validator %X", address)
+}
+
+// InsertBlock adds a block. It returns ErrConflict if the block cannot be
+// inserted.
+func (s *MemStore) InsertBlock(ctx context.Context, b Block) error {
+	return s.InsertBlocks(ctx, []Block{b})
+}
+
+// InsertBlocks adds all given blocks. It returns ErrConflict if any of the
+// blocks cannot be inserted, in which case none is.
+func (s *MemStore) InsertBlocks(ctx context.Context, blocks []Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	heights := make(map[int64]struct{}, len(blocks))
+	for _, b := range blocks {
+		if err := s.checkBlock(b); err != nil {
+			return err
+		}
+		if _, ok := heights[b.Height]; ok {
+			return errors.Wrapf(ErrConflict, "block %d exists", b.Height)
+		}
+		heights[b.Height] = struct{}{}
+	}
+	for _, b := range blocks {
+		c := cloneBlock(&b)
+		for _, tx := range c.Transactions {
+			s.lastTxID++
+			s.transactions = append(s.transactions, memTransaction{
+				id:               s.lastTxID,
+				BlockTransaction: BlockTransaction{BlockHeight: b.Height, Transaction: tx},
+			})
+		}
+		// Transactions are not loaded with the block.
+		c.Transactions = nil
+		s.blocks[b.Height] = c
+	}
+	return nil
+}
+
+// checkBlock returns ErrConflict if given block cannot be inserted.
+func (s *MemStore) checkBlock(b Block) error {
+	if len(b.ParticipantIDs) == 0 {
+		return errors.Wrapf(ErrConflict, "no participants on block %d", b.Height)
+	}
+	if _, ok := s.blocks[b.Height]; ok {
+		return errors.Wrapf(ErrConflict, "block %d exists", b.Height)
+	}
+	if !s.hasValidator(b.ProposerID) {
+		return errors.Wrapf(ErrConflict, "block %d: no proposer %d", b.Height, b.ProposerID)
+	}
+
+	seen := make(map[int64]struct{})
+	for _, ids := range [][]int64{b.ParticipantIDs, b.MissingIDs, b.NilVoteIDs} {
+		for _, id := range ids {
+			if !s.hasValidator(id) {
+				return errors.Wrapf(ErrConflict, "block %d: no validator %d", b.Height, id)
+			}
+			if _, ok := seen[id]; ok {
+				return errors.Wrapf(ErrConflict, "block %d: duplicated participation of validator %d", b.Height, id)
+			}
+			seen[id] = struct{}{}
+		}
+	}
+
+	tickers := make(map[string]struct{})
+	for _, fee := range b.Fees {
+		if _, ok := tickers[fee.Ticker]; ok {
+			return errors.Wrapf(ErrConflict, "block %d: duplicated %s fee", b.Height, fee.Ticker)
+		}
+		tickers[fee.Ticker] = struct{}{}
+	}
+	return nil
+}
+
+func (s *MemStore) hasValidator(id int64) bool {
+	return id > 0 && id <= int64(len(s.validators))
+}
+
+// LatestBlock returns the block with the greatest height. It returns
+// ErrNotFound if there are no blocks.
+func (s *MemStore) LatestBlock(ctx context.Context) (*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var latest *Block
+	for _, b := range s.blocks {
+		if latest == nil || b.Height > latest.Height {
+			latest = b
+		}
+	}
+	if latest == nil {
+		return nil, errors.Wrap(ErrNotFound, "no blocks")
+	}
+	return loadedBlock(latest), nil
+}
+
+// LoadBlock returns the block with given height. It returns ErrNotFound if no
+// such block exists.
+func (s *MemStore) LoadBlock(ctx context.Context, blockHeight int64) (*Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, ok := s.blocks[blockHeight]
+	if !ok {
+		return nil, errors.Wrap(ErrNotFound, "no blocks")
+	}
+	return loadedBlock(b), nil
+}
+
+// DeleteBlocksAbove removes all blocks with the height greater than given one
+// and returns their number.
+func (s *MemStore) DeleteBlocksAbove(ctx context.Context, blockHeight int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for h := range s.blocks {
+		if h > blockHeight {
+			delete(s.blocks, h)
+			deleted++
+		}
+	}
+	txs := s.transactions[:0]
+	for _, tx := range s.transactions {
+		if tx.BlockHeight <= blockHeight {
+			txs = append(txs, tx)
+		}
+	}
+	s.transactions = txs
+	return deleted, nil
+}
+
+// InsertValidatorSet adds the validator set identified by given hash. Members
+// that are already present are not modified.
+func (s *MemStore) InsertValidatorSet(ctx context.Context, hash []byte, firstHeight int64, members []ValidatorSetMember) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range members {
+		if !s.hasValidator(m.ValidatorID) {
+			return errors.Wrapf(ErrConflict, "no validator %d", m.ValidatorID)
+		}
+	}
+
+	set := s.validatorSets[string(hash)]
+	for _, m := range members {
+		var exists bool
+		for _, present := range set {
+			exists = exists || present.ValidatorID == m.ValidatorID
+		}
+		if !exists {
+			set = append(set, m)
+		}
+	}
+	sort.SliceStable(set, func(i, j int) bool {
+		if set[i].VotingPower != set[j].VotingPower {
+			return set[i].VotingPower > set[j].VotingPower
+		}
+		return set[i].ValidatorID < set[j].ValidatorID
+	})
+	if len(set) != 0 {
+		s.validatorSets[string(hash)] = set
+	}
+	return nil
+}
+
+// LoadValidatorSet returns all members of the validator set identified by
+// given hash, ordered by the voting power, highest first. It returns
+// ErrNotFound if no such set exists.
+func (s *MemStore) LoadValidatorSet(ctx context.Context, hash []byte) ([]ValidatorSetMember, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	set, ok := s.validatorSets[string(hash)]
+	if !ok {
+		return nil, errors.Wrapf(ErrNotFound, "validator set %X", hash)
+	}
+	return append([]ValidatorSetMember(nil), set...), nil
+}
+
+// UpdateSyncState replaces the stored synchronization progress.
+func (s *MemStore) UpdateSyncState(ctx context.Context, state SyncState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if state.StoppedAt != nil {
+		t := *state.StoppedAt
+		state.StoppedAt = &t
+	}
+	s.syncState = &state
+	return nil
+}
+
+// LoadSyncState returns the synchronization progress. It returns ErrNotFound
+// if no state was written yet.
+func (s *MemStore) LoadSyncState(ctx context.Context) (*SyncState, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.syncState == nil {
+		return nil, errors.Wrap(ErrNotFound, "select sync state")
+	}
+	state := *s.syncState
+	if state.StoppedAt != nil {
+		t := *state.StoppedAt
+		state.StoppedAt = &t
+	}
+	return &state, nil
+}
+
+// Blocks returns blocks matching given filter, the highest first. The cursor
+// of the next page is empty if there are no more results.
+func (s *MemStore) Blocks(ctx context.Context, f BlockFilter, p Page) ([]*Block, string, error) {
+	after, limit, err := p.parse()
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	heights := make([]int64, 0, len(s.blocks))
+	for h := range s.blocks {
+		heights = append(heights, h)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] > heights[j] })
+
+	var blocks []*Block
+	for _, h := range heights {
+		b := s.blocks[h]
+		switch {
+		case after != 0 && h >= after:
+			continue
+		case f.FromHeight != 0 && h < f.FromHeight:
+			continue
+		case f.ToHeight != 0 && h > f.ToHeight:
+			continue
+		case !f.FromTime.IsZero() && b.Time.Before(f.FromTime):
+			continue
+		case !f.ToTime.IsZero() && !b.Time.Before(f.ToTime):
+			continue
+		case f.ProposerID != 0 && b.ProposerID != f.ProposerID:
+			continue
+		case f.HasMissed && len(b.MissingIDs) == 0:
+			continue
+		}
+		if len(blocks) == limit {
+			return blocks, pageCursor(blocks[limit-1].Height), nil
+		}
+		blocks = append(blocks, loadedBlock(b))
+	}
+	return blocks, "", nil
+}
+
+// Transactions returns transactions matching given filter, the most recent
+// first. The cursor of the next page is empty if there are no more results.
+func (s *MemStore) Transactions(ctx context.Context, f TransactionFilter, p Page) ([]*BlockTransaction, string, error) {
+	after, limit, err := p.parse()
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var (
+		txs    []*BlockTransaction
+		lastID int64
+	)
+	for i := len(s.transactions) - 1; i >= 0; i-- {
+		tx := s.transactions[i]
+		switch {
+		case after != 0 && tx.id >= after:
+			continue
+		case len(f.Hash) != 0 && !bytes.Equal(tx.Hash, f.Hash):
+			continue
+		case f.MessagePath != "" && !hasMessagePath(tx.Messages, f.MessagePath):
+			continue
+		case f.FromHeight != 0 && tx.BlockHeight < f.FromHeight:
+			continue
+		case f.ToHeight != 0 && tx.BlockHeight > f.ToHeight:
+			continue
+		}
+		if len(txs) == limit {
+			return txs, pageCursor(lastID), nil
+		}
+		c := cloneBlock(&Block{Transactions: []Transaction{tx.Transaction}})
+		txs = append(txs, &BlockTransaction{
+			BlockHeight: tx.BlockHeight,
+			Transaction: c.Transactions[0],
+		})
+		lastID = tx.id
+	}
+	return txs, "", nil
+}
+
+func hasMessagePath(msgs []Message, path string) bool {
+	for _, m := range msgs {
+		if m.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Validators returns validators matching given filter, ordered by ID, with
+// their participation counted over the blocks within the filter height range.
+// The cursor of the next page is empty if there are no more results.
+func (s *MemStore) Validators(ctx context.Context, f ValidatorFilter, p Page) ([]*ValidatorStats, string, error) {
+	after, limit, err := p.parse()
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var validators []*ValidatorStats
+	for _, v := range s.validators {
+		if v.id <= after || (len(f.Address) != 0 && !bytes.Equal(v.address, f.Address)) {
+			continue
+		}
+		if len(validators) == limit {
+			return validators, pageCursor(validators[limit-1].ID), nil
+		}
+		stats := &ValidatorStats{
+			ID:        v.id,
+			Address:   cloneBytes(v.address),
+			PublicKey: cloneBytes(v.publicKey),
+		}
+		for h, b := range s.blocks {
+			if (f.FromHeight != 0 && h < f.FromHeight) || (f.ToHeight != 0 && h > f.ToHeight) {
+				continue
+			}
+			stats.Signed += countID(b.ParticipantIDs, v.id)
+			stats.Missed += countID(b.MissingIDs, v.id)
+			stats.NilVotes += countID(b.NilVoteIDs, v.id)
+		}
+		validators = append(validators, stats)
+	}
+	return validators, "", nil
+}
+
+// ValidatorAddresses returns the addresses of validators with given IDs.
+// Validators that do not exist are not included.
+func (s *MemStore) ValidatorAddresses(ctx context.Context, ids []int64) (map[int64][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	addresses := make(map[int64][]byte, len(ids))
+	for _, id := range ids {
+		if s.hasValidator(id) {
+			addresses[id] = cloneBytes(s.validators[id-1].address)
+		}
+	}
+	return addresses, nil
+}
+
+// Participations returns the participation of a validator in the blocks
+// matching given filter, the highest first. The cursor of the next page is
+// empty if there are no more results.
+func (s *MemStore) Participations(ctx context.Context, f ParticipationFilter, p Page) ([]*Participation, string, error) {
+	after, limit, err := p.parse()
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	heights := make([]int64, 0, len(s.blocks))
+	for h := range s.blocks {
+		heights = append(heights, h)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] > heights[j] })
+
+	var participations []*Participation
+	for _, h := range heights {
+		b := s.blocks[h]
+		var status ParticipationStatus
+		switch {
+		case countID(b.ParticipantIDs, f.ValidatorID) != 0:
+			status = Signed
+		case countID(b.MissingIDs, f.ValidatorID) != 0:
+			status = Missed
+		case countID(b.NilVoteIDs, f.ValidatorID) != 0:
+			status = NilVote
+		default:
+			// Validator was not expected to vote.
+			continue
+		}
+		switch {
+		case after != 0 && h >= after:
+			continue
+		case f.FromHeight != 0 && h < f.FromHeight:
+			continue
+		case f.ToHeight != 0 && h > f.ToHeight:
+			continue
+		case f.Missed && status != Missed:
+			continue
+		}
+		if len(participations) == limit {
+			return participations, pageCursor(participations[limit-1].BlockHeight), nil
+		}
+		participations = append(participations, &Participation{
+			BlockHeight: h,
+			BlockTime:   b.Time.UTC(),
+			ProposerID:  b.ProposerID,
+			Status:      status,
+		})
+	}
+	return participations, "", nil
+}
+
+func countID(ids []int64, id int64) int64 {
+	var n int64
+	for _, i := range ids {
+		if i == id {
+			n++
+		}
+	}
+	return n
+}
+
+// loadedBlock returns a copy of given block as loaded from the database. The
+// time is normalized and fees are ordered by ticker.
+func loadedBlock(b *Block) *Block {
+	c := cloneBlock(b)
+	c.Time = c.Time.UTC()
+	sort.Slice(c.Fees, func(i, j int) bool {
+		return c.Fees[i].Ticker < c.Fees[j].Ticker
+	})
+	return c
+}
+
+// cloneBlock returns a deep copy of given block, so that it does not share
+// any memory with the one owned by the caller.
+func cloneBlock(b *Block) *Block {
+	c := *b
+	c.Hash = cloneBytes(b.Hash)
+	c.ValidatorsHash = cloneBytes(b.ValidatorsHash)
+	c.ParticipantIDs = cloneIDs(b.ParticipantIDs)
+	c.MissingIDs = cloneIDs(b.MissingIDs)
+	c.NilVoteIDs = cloneIDs(b.NilVoteIDs)
+	if b.Messages != nil {
+		c.Messages = append([]string(nil), b.Messages...)
+	}
+	c.Fees = nil
+	for _, fee := range b.Fees {
+		c.Fees = append(c.Fees, fee.Clone())
+	}
+	c.Transactions = nil
+	for _, tx := range b.Transactions {
+		t := tx
+		t.Hash = cloneBytes(tx.Hash)
+		if tx.Fee != nil {
+			t.Fee = tx.Fee.Clone()
+		}
+		t.Messages = append([]Message(nil), tx.Messages...)
+		c.Transactions = append(c.Transactions, t)
+	}
+	return &c
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func cloneIDs(ids []int64) []int64 {
+	if len(ids) == 0 {
+		return nil
+	}
+	return append([]int64(nil), ids...)
+}
@@ -10,79 +10,74 @@ import (
 	"time"
 
 	"github.com/iov-one/block-metrics/pkg/errors"
+	"github.com/iov-one/weave/coin"
 	_ "github.com/lib/pq"
 )
 
 func TestLastBlock(t *testing.T) {
-	db, cleanup := ensureDB(t)
-	defer cleanup()
+	eachStore(t, func(t *testing.T, s BlockStore) {
+		ctx := context.Background()
 
-	ctx := context.Background()
-
-	s := NewStore(db)
-
-	if _, err := s.LatestBlock(ctx); !ErrNotFound.Is(err) {
-		t.Fatalf("want ErrNotFound, got %q", err)
-	}
-
-	vID, err := s.InsertValidator(ctx, []byte{0x01, 0, 0xbe, 'a'}, []byte{0x02})
-	if err != nil {
-		t.Fatalf("cannot create a validator: %s", err)
-	}
-
-	for i := 5; i < 100; i += 20 {
-		block := Block{
-			Height: int64(i),
-			Hash:   []byte{0, 1, byte(i)},
-			// Postgres TIMESTAMPTZ precision is microseconds.
-			Time:           time.Now().UTC().Round(time.Microsecond),
-			ProposerID:     vID,
-			ParticipantIDs: []int64{vID},
-			Messages:       []string{"test/mymsg"},
-		}
-		if err := s.InsertBlock(ctx, block); err != nil {
-			t.Fatalf("cannot insert block: %s", err)
+		if _, err := s.LatestBlock(ctx); !ErrNotFound.Is(err) {
+			t.Fatalf("want ErrNotFound, got %q", err)
 		}
 
-		got, err := s.LatestBlock(ctx)
+		vID, err := s.InsertValidator(ctx, []byte{0x01, 0, 0xbe, 'a'}, []byte{0x02})
 		if err != nil {
-			t.Fatalf("cannot get latest block: %s", err)
+			t.Fatalf("cannot create a validator: %s", err)
 		}
 
-		if !reflect.DeepEqual(got, &block) {
-			t.Logf(" got %#v", got)
-			t.Logf("want %#v", &block)
-			t.Fatal("unexpected result")
+		for i := 5; i < 100; i += 20 {
+			block := Block{
+				Height: int64(i),
+				Hash:   []byte{0, 1, byte(i)},
+				// Postgres TIMESTAMPTZ precision is microseconds.
+				Time:           time.Now().UTC().Round(time.Microsecond),
+				ProposerID:     vID,
+				ParticipantIDs: []int64{vID},
+				Messages:       []string{"test/mymsg"},
+			}
+			if err := s.InsertBlock(ctx, block); err != nil {
+				t.Fatalf("cannot insert block: %s", err)
+			}
+
+			got, err := s.LatestBlock(ctx)
+			if err != nil {
+				t.Fatalf("cannot get latest block: %s", err)
+			}
+
+			if !reflect.DeepEqual(got, &block) {
+				t.Logf(" got %#v", got)
+				t.Logf("want %#v", &block)
+				t.Fatal("unexpected result")
+			}
 		}
-	}
+	})
 }
 
 func TestStoreInsertValidator(t *testing.T) {
-	db, cleanup := ensureDB(t)
-	defer cleanup()
+	eachStore(t, func(t *testing.T, s BlockStore) {
+		ctx := context.Background()
 
-	ctx := context.Background()
-
-	s := NewStore(db)
-
-	pubkeyA := []byte{0x01, 0, 0xbe, 'a'}
-	addrA := []byte{0x02, 'a'}
-	if _, err := s.InsertValidator(ctx, pubkeyA, addrA); err != nil {
-		t.Fatalf("cannot create 'a' validator: %s", err)
-	}
+		pubkeyA := []byte{0x01, 0, 0xbe, 'a'}
+		addrA := []byte{0x02, 'a'}
+		if _, err := s.InsertValidator(ctx, pubkeyA, addrA); err != nil {
+			t.Fatalf("cannot create 'a' validator: %s", err)
+		}
 
-	pubkeyB := []byte{0x01, 0, 0xbe, 'b'}
-	addrB := []byte{0x02, 'b'}
-	if _, err := s.InsertValidator(ctx, pubkeyB, addrB); err != nil {
-		t.Fatalf("cannot create 'b' validator: %s", err)
-	}
+		pubkeyB := []byte{0x01, 0, 0xbe, 'b'}
+		addrB := []byte{0x02, 'b'}
+		if _, err := s.InsertValidator(ctx, pubkeyB, addrB); err != nil {
+			t.Fatalf("cannot create 'b' validator: %s", err)
+		}
 
-	if _, err := s.InsertValidator(ctx, pubkeyA, []byte{0x99}); !ErrConflict.Is(err) {
-		t.Fatalf("was able to create a validator with an existing public key: %q", err)
-	}
-	if _, err := s.InsertValidator(ctx, []byte{0x99}, addrA); !ErrConflict.Is(err) {
-		t.Fatalf("was able to create a validator with an existing address: %q", err)
-	}
+		if _, err := s.InsertValidator(ctx, pubkeyA, []byte{0x99}); !ErrConflict.Is(err) {
+			t.Fatalf("was able to create a validator with an existing public key: %q", err)
+		}
+		if _, err := s.InsertValidator(ctx, []byte{0x99}, addrA); !ErrConflict.Is(err) {
+			t.Fatalf("was able to create a validator with an existing address: %q", err)
+		}
+	})
 }
 
 func TestStoreInsertBlock(t *testing.T) {
@@ -126,6 +121,44 @@ func TestStoreInsertBlock(t *testing.T) {
 				Messages:       []string{"test/one", "test/two"},
 			},
 		},
+		"success with fees in many currencies": {
+			validators: []validator{
+				{address: []byte{0x01}, pubkey: []byte{0x01, 0, 0x01}},
+				{address: []byte{0x02}, pubkey: []byte{0x02, 0, 0x02}},
+			},
+			block: Block{
+				Height:         3,
+				Hash:           []byte{0, 1, 2, 3},
+				Time:           time.Now().UTC().Round(time.Millisecond),
+				ProposerID:     1,
+				ParticipantIDs: []int64{1, 2},
+				Messages:       []string{"test/one", "test/two"},
+				FeeFrac:        20,
+				Fees: coin.Coins{
+					coin.NewCoinp(1, 5, "ETH"),
+					coin.NewCoinp(0, 20, "IOV"),
+				},
+				Transactions: []Transaction{
+					{
+						Hash:    []byte{0x01},
+						Message: "{}",
+						Fee:     coin.NewCoinp(1, 5, "ETH"),
+						Messages: []Message{
+							{Path: "test/one", Details: `{"a": 1}`},
+						},
+					},
+					{
+						Hash:    []byte{0x02},
+						Message: "[]",
+						Fee:     coin.NewCoinp(0, 20, "IOV"),
+						Messages: []Message{
+							{Path: "test/two", Details: `{"b": 2}`},
+							{Path: "test/two", Details: `{"b": 3}`},
+						},
+					},
+				},
+			},
+		},
 		"missing participant ids": {
 			validators: []validator{
 				{address: []byte{0x01}, pubkey: []byte{0x01, 0, 0x01}},
@@ -177,36 +210,608 @@ func TestStoreInsertBlock(t *testing.T) {
 
 	for testName, tc := range cases {
 		t.Run(testName, func(t *testing.T) {
-			db, cleanup := ensureDB(t)
-			defer cleanup()
+			eachStore(t, func(t *testing.T, s BlockStore) {
+				ctx := context.Background()
+
+				for _, v := range tc.validators {
+					if _, err := s.InsertValidator(ctx, v.pubkey, v.address); err != nil {
+						t.Fatalf("cannot ensure validator: %s", err)
+					}
+				}
 
-			ctx := context.Background()
-			s := NewStore(db)
+				if err := s.InsertBlock(ctx, tc.block); !tc.wantErr.Is(err) {
+					t.Fatalf("want %q error, got %q", tc.wantErr, err)
+				}
 
-			for _, v := range tc.validators {
-				if _, err := s.InsertValidator(ctx, v.pubkey, v.address); err != nil {
-					t.Fatalf("cannot ensure validator: %s", err)
+				if tc.wantErr == nil {
+					// ensure we can load it back the same
+					loaded, err := s.LoadBlock(ctx, tc.block.Height)
+					if err != nil {
+						t.Fatalf("cannot re-load block %v", err)
+					}
+					want := tc.block
+					// Transactions are not loaded with the block.
+					want.Transactions = nil
+					if !reflect.DeepEqual(loaded, &want) {
+						t.Logf(" got %#v", loaded)
+						t.Logf("want %#v", &want)
+						t.Fatal("unexpected result")
+					}
 				}
+			})
+		})
+	}
+}
+
+func TestStoreInsertBlocks(t *testing.T) {
+	eachStore(t, func(t *testing.T, s BlockStore) {
+		ctx := context.Background()
+
+		var ids []int64
+		for i := byte(1); i <= 3; i++ {
+			id, err := s.InsertValidator(ctx, []byte{i, 0, i}, []byte{i})
+			if err != nil {
+				t.Fatalf("cannot create a validator: %s", err)
 			}
+			ids = append(ids, id)
+		}
 
-			if err := s.InsertBlock(ctx, tc.block); !tc.wantErr.Is(err) {
-				t.Fatalf("want %q error, got %q", tc.wantErr, err)
+		var blocks []Block
+		for i := 1; i <= 10; i++ {
+			blocks = append(blocks, Block{
+				Height:         int64(i),
+				Hash:           []byte{0, 1, byte(i)},
+				Time:           time.Now().UTC().Round(time.Microsecond),
+				ProposerID:     ids[i%3],
+				ParticipantIDs: []int64{ids[0], ids[1]},
+				MissingIDs:     []int64{ids[2]},
+				Messages:       []string{"test/one", "test/two"},
+				FeeFrac:        uint64(i),
+			})
+		}
+		if err := s.InsertBlocks(ctx, blocks); err != nil {
+			t.Fatalf("cannot insert blocks: %s", err)
+		}
+
+		for _, want := range blocks {
+			got, err := s.LoadBlock(ctx, want.Height)
+			if err != nil {
+				t.Fatalf("cannot load block %d: %s", want.Height, err)
+			}
+			if !reflect.DeepEqual(got, &want) {
+				t.Logf(" got %#v", got)
+				t.Logf("want %#v", &want)
+				t.Fatal("unexpected result")
 			}
+		}
 
-			if tc.wantErr == nil {
-				// ensure we can load it back the same
-				loaded, err := s.LoadBlock(ctx, tc.block.Height)
-				if err != nil {
-					t.Fatalf("cannot re-load block %v", err)
+		// Inserting any existing block must fail the whole batch.
+		conflict := []Block{blocks[9], blocks[0]}
+		conflict[0].Height = 11
+		if err := s.InsertBlocks(ctx, conflict); !ErrConflict.Is(err) {
+			t.Fatalf("want ErrConflict, got %q", err)
+		}
+		if _, err := s.LoadBlock(ctx, 11); !ErrNotFound.Is(err) {
+			t.Fatalf("want ErrNotFound, got %q", err)
+		}
+	})
+}
+
+func TestStoreDeleteBlocksAbove(t *testing.T) {
+	eachStore(t, func(t *testing.T, s BlockStore) {
+		ctx := context.Background()
+
+		vID, err := s.InsertValidator(ctx, []byte{0x01, 0, 0xbe, 'a'}, []byte{0x02})
+		if err != nil {
+			t.Fatalf("cannot create a validator: %s", err)
+		}
+
+		for i := 1; i <= 5; i++ {
+			block := Block{
+				Height:         int64(i),
+				Hash:           []byte{0, 1, byte(i)},
+				Time:           time.Now().UTC().Round(time.Microsecond),
+				ProposerID:     vID,
+				ParticipantIDs: []int64{vID},
+				Messages:       []string{"test/mymsg"},
+				Transactions: []Transaction{
+					{Hash: []byte{byte(i)}, Message: "{}"},
+				},
+			}
+			if err := s.InsertBlock(ctx, block); err != nil {
+				t.Fatalf("cannot insert block: %s", err)
+			}
+		}
+
+		deleted, err := s.DeleteBlocksAbove(ctx, 2)
+		if err != nil {
+			t.Fatalf("cannot delete blocks: %s", err)
+		}
+		if deleted != 3 {
+			t.Fatalf("want 3 blocks deleted, got %d", deleted)
+		}
+
+		latest, err := s.LatestBlock(ctx)
+		if err != nil {
+			t.Fatalf("cannot get latest block: %s", err)
+		}
+		if latest.Height != 2 {
+			t.Fatalf("want latest block height 2, got %d", latest.Height)
+		}
+		if _, err := s.LoadBlock(ctx, 3); !ErrNotFound.Is(err) {
+			t.Fatalf("want ErrNotFound, got %q", err)
+		}
+	})
+}
+
+func TestStoreSyncState(t *testing.T) {
+	eachStore(t, func(t *testing.T, s BlockStore) {
+		ctx := context.Background()
+
+		if _, err := s.LoadSyncState(ctx); !ErrNotFound.Is(err) {
+			t.Fatalf("want ErrNotFound, got %q", err)
+		}
+
+		// Postgres TIMESTAMPTZ precision is microseconds.
+		now := time.Now().UTC().Round(time.Microsecond)
+		state := SyncState{
+			NodeURI:      "ws://localhost:26657/websocket",
+			SyncedHeight: 10,
+			ChainHeight:  20,
+			StartedAt:    now,
+			UpdatedAt:    now,
+		}
+		if err := s.UpdateSyncState(ctx, state); err != nil {
+			t.Fatalf("cannot update sync state: %s", err)
+		}
+
+		stopped := now.Add(time.Minute)
+		state.SyncedHeight = 20
+		state.LastError = "test error"
+		state.UpdatedAt = stopped
+		state.StoppedAt = &stopped
+		if err := s.UpdateSyncState(ctx, state); err != nil {
+			t.Fatalf("cannot update sync state: %s", err)
+		}
+
+		got, err := s.LoadSyncState(ctx)
+		if err != nil {
+			t.Fatalf("cannot load sync state: %s", err)
+		}
+		if !reflect.DeepEqual(got, &state) {
+			t.Logf(" got %#v", got)
+			t.Logf("want %#v", &state)
+			t.Fatal("unexpected result")
+		}
+	})
+}
+
+func TestStoreValidatorSet(t *testing.T) {
+	eachStore(t, func(t *testing.T, s BlockStore) {
+		ctx := context.Background()
+
+		aliceID, err := s.InsertValidator(ctx, []byte{0x01}, []byte{0x11})
+		if err != nil {
+			t.Fatalf("cannot insert validator: %s", err)
+		}
+		bobID, err := s.InsertValidator(ctx, []byte{0x02}, []byte{0x22})
+		if err != nil {
+			t.Fatalf("cannot insert validator: %s", err)
+		}
+
+		hash := []byte("validators hash")
+		if _, err := s.LoadValidatorSet(ctx, hash); !ErrNotFound.Is(err) {
+			t.Fatalf("want ErrNotFound, got %q", err)
+		}
+
+		members := []ValidatorSetMember{
+			{ValidatorID: aliceID, VotingPower: 5, ProposerPriority: -3},
+			{ValidatorID: bobID, VotingPower: 10, ProposerPriority: 3},
+		}
+		if err := s.InsertValidatorSet(ctx, hash, 1, members); err != nil {
+			t.Fatalf("cannot insert validator set: %s", err)
+		}
+		// Set seen again must not be modified.
+		changed := []ValidatorSetMember{
+			{ValidatorID: aliceID, VotingPower: 5, ProposerPriority: 7},
+		}
+		if err := s.InsertValidatorSet(ctx, hash, 2, changed); err != nil {
+			t.Fatalf("cannot insert validator set again: %s", err)
+		}
+
+		got, err := s.LoadValidatorSet(ctx, hash)
+		if err != nil {
+			t.Fatalf("cannot load validator set: %s", err)
+		}
+		want := []ValidatorSetMember{members[1], members[0]}
+		if !reflect.DeepEqual(got, want) {
+			t.Logf(" got %#v", got)
+			t.Logf("want %#v", want)
+			t.Fatal("unexpected result")
+		}
+	})
+}
+
+func TestStoreBlocks(t *testing.T) {
+	eachStore(t, func(t *testing.T, s BlockStore) {
+		ctx := context.Background()
+		ids := insertQueryFixture(t, s)
+
+		baseTime := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+		cases := map[string]struct {
+			filter      BlockFilter
+			wantHeights []int64
+		}{
+			"all": {
+				wantHeights: []int64{6, 5, 4, 3, 2, 1},
+			},
+			"height range": {
+				filter:      BlockFilter{FromHeight: 2, ToHeight: 4},
+				wantHeights: []int64{4, 3, 2},
+			},
+			"time range": {
+				filter:      BlockFilter{FromTime: baseTime.Add(time.Minute), ToTime: baseTime.Add(3 * time.Minute)},
+				wantHeights: []int64{3, 2},
+			},
+			"proposer": {
+				filter:      BlockFilter{ProposerID: ids[1]},
+				wantHeights: []int64{5, 2},
+			},
+			"has missed": {
+				filter:      BlockFilter{HasMissed: true},
+				wantHeights: []int64{4, 2},
+			},
+			"has missed in range": {
+				filter:      BlockFilter{HasMissed: true, ToHeight: 3},
+				wantHeights: []int64{2},
+			},
+		}
+		for testName, tc := range cases {
+			t.Run(testName, func(t *testing.T) {
+				// Use a small page to test the pagination.
+				var (
+					heights []int64
+					page    = Page{Limit: 2}
+				)
+				for {
+					blocks, next, err := s.Blocks(ctx, tc.filter, page)
+					if err != nil {
+						t.Fatalf("cannot query blocks: %s", err)
+					}
+					for _, b := range blocks {
+						heights = append(heights, b.Height)
+					}
+					if next == "" {
+						break
+					}
+					page.Cursor = next
+				}
+				if !reflect.DeepEqual(heights, tc.wantHeights) {
+					t.Fatalf("want heights %v, got %v", tc.wantHeights, heights)
 				}
-				if !reflect.DeepEqual(loaded, &tc.block) {
-					t.Logf(" got %#v", loaded)
-					t.Logf("want %#v", &tc.block)
+			})
+		}
+
+		blocks, _, err := s.Blocks(ctx, BlockFilter{FromHeight: 4, ToHeight: 4}, Page{})
+		if err != nil {
+			t.Fatalf("cannot query blocks: %s", err)
+		}
+		want, err := s.LoadBlock(ctx, 4)
+		if err != nil {
+			t.Fatalf("cannot load block: %s", err)
+		}
+		if len(blocks) != 1 || !reflect.DeepEqual(blocks[0], want) {
+			t.Logf(" got %#v", blocks)
+			t.Logf("want %#v", want)
+			t.Fatal("unexpected result")
+		}
+
+		if _, _, err := s.Blocks(ctx, BlockFilter{}, Page{Cursor: "invalid"}); !ErrInvalid.Is(err) {
+			t.Fatalf("want ErrInvalid, got %q", err)
+		}
+	})
+}
+
+func TestStoreTransactions(t *testing.T) {
+	eachStore(t, func(t *testing.T, s BlockStore) {
+		ctx := context.Background()
+		insertQueryFixture(t, s)
+
+		cases := map[string]struct {
+			filter     TransactionFilter
+			wantHashes [][]byte
+		}{
+			"all": {
+				wantHashes: [][]byte{{0x05, 1}, {0x05, 0}, {0x03, 1}, {0x03, 0}, {0x01, 0}},
+			},
+			"hash": {
+				filter:     TransactionFilter{Hash: []byte{0x03, 1}},
+				wantHashes: [][]byte{{0x03, 1}},
+			},
+			"unknown hash": {
+				filter: TransactionFilter{Hash: []byte{0x99}},
+			},
+			"message path": {
+				filter:     TransactionFilter{MessagePath: "cash/send"},
+				wantHashes: [][]byte{{0x05, 0}, {0x03, 0}, {0x01, 0}},
+			},
+			"message path in range": {
+				filter:     TransactionFilter{MessagePath: "cash/send", FromHeight: 2, ToHeight: 4},
+				wantHashes: [][]byte{{0x03, 0}},
+			},
+		}
+		for testName, tc := range cases {
+			t.Run(testName, func(t *testing.T) {
+				var (
+					hashes [][]byte
+					page   = Page{Limit: 2}
+				)
+				for {
+					txs, next, err := s.Transactions(ctx, tc.filter, page)
+					if err != nil {
+						t.Fatalf("cannot query transactions: %s", err)
+					}
+					for _, tx := range txs {
+						hashes = append(hashes, tx.Hash)
+					}
+					if next == "" {
+						break
+					}
+					page.Cursor = next
+				}
+				if !reflect.DeepEqual(hashes, tc.wantHashes) {
+					t.Fatalf("want hashes %x, got %x", tc.wantHashes, hashes)
+				}
+			})
+		}
+
+		txs, _, err := s.Transactions(ctx, TransactionFilter{Hash: []byte{0x03, 1}}, Page{})
+		if err != nil {
+			t.Fatalf("cannot query transactions: %s", err)
+		}
+		want := []*BlockTransaction{
+			{
+				BlockHeight: 3,
+				Transaction: Transaction{
+					Hash:    []byte{0x03, 1},
+					Message: `{"multi":true}`,
+					Fee:     coin.NewCoinp(0, 5, "IOV"),
+					Messages: []Message{
+						{Path: "username/register", Details: `{"a": 1}`},
+						{Path: "multisig/create", Details: `{"b": 2}`},
+					},
+				},
+			},
+		}
+		if !reflect.DeepEqual(txs, want) {
+			t.Logf(" got %#v", txs)
+			t.Logf("want %#v", want)
+			t.Fatal("unexpected result")
+		}
+	})
+}
+
+func TestStoreValidators(t *testing.T) {
+	eachStore(t, func(t *testing.T, s BlockStore) {
+		ctx := context.Background()
+		ids := insertQueryFixture(t, s)
+
+		cases := map[string]struct {
+			filter ValidatorFilter
+			want   []*ValidatorStats
+		}{
+			"all blocks": {
+				want: []*ValidatorStats{
+					{ID: ids[0], Address: []byte{0x01}, PublicKey: []byte{0x01, 0, 0x01}, Signed: 6},
+					{ID: ids[1], Address: []byte{0x02}, PublicKey: []byte{0x02, 0, 0x02}, Signed: 4, Missed: 1, NilVotes: 1},
+					{ID: ids[2], Address: []byte{0x03}, PublicKey: []byte{0x03, 0, 0x03}, Signed: 5, Missed: 1},
+				},
+			},
+			"height range": {
+				filter: ValidatorFilter{FromHeight: 3, ToHeight: 4},
+				want: []*ValidatorStats{
+					{ID: ids[0], Address: []byte{0x01}, PublicKey: []byte{0x01, 0, 0x01}, Signed: 2},
+					{ID: ids[1], Address: []byte{0x02}, PublicKey: []byte{0x02, 0, 0x02}, Signed: 1, NilVotes: 1},
+					{ID: ids[2], Address: []byte{0x03}, PublicKey: []byte{0x03, 0, 0x03}, Signed: 1, Missed: 1},
+				},
+			},
+			"address": {
+				filter: ValidatorFilter{Address: []byte{0x02}, ToHeight: 2},
+				want: []*ValidatorStats{
+					{ID: ids[1], Address: []byte{0x02}, PublicKey: []byte{0x02, 0, 0x02}, Signed: 1, Missed: 1},
+				},
+			},
+		}
+		for testName, tc := range cases {
+			t.Run(testName, func(t *testing.T) {
+				var (
+					got  []*ValidatorStats
+					page = Page{Limit: 2}
+				)
+				for {
+					validators, next, err := s.Validators(ctx, tc.filter, page)
+					if err != nil {
+						t.Fatalf("cannot query validators: %s", err)
+					}
+					got = append(got, validators...)
+					if next == "" {
+						break
+					}
+					page.Cursor = next
+				}
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Logf(" got %#v", got)
+					t.Logf("want %#v", tc.want)
 					t.Fatal("unexpected result")
 				}
+			})
+		}
+	})
+}
+
+func TestStoreParticipations(t *testing.T) {
+	eachStore(t, func(t *testing.T, s BlockStore) {
+		ctx := context.Background()
+		ids := insertQueryFixture(t, s)
+
+		cases := map[string]struct {
+			filter ParticipationFilter
+			want   map[int64]ParticipationStatus
+			// wantHeights is the expected order of results.
+			wantHeights []int64
+		}{
+			"all": {
+				filter:      ParticipationFilter{ValidatorID: ids[1]},
+				wantHeights: []int64{6, 5, 4, 3, 2, 1},
+				want:        map[int64]ParticipationStatus{6: Signed, 5: Signed, 4: NilVote, 3: Signed, 2: Missed, 1: Signed},
+			},
+			"height range": {
+				filter:      ParticipationFilter{ValidatorID: ids[2], FromHeight: 3, ToHeight: 4},
+				wantHeights: []int64{4, 3},
+				want:        map[int64]ParticipationStatus{4: Missed, 3: Signed},
+			},
+			"missed": {
+				filter:      ParticipationFilter{ValidatorID: ids[1], Missed: true},
+				wantHeights: []int64{2},
+				want:        map[int64]ParticipationStatus{2: Missed},
+			},
+		}
+		for testName, tc := range cases {
+			t.Run(testName, func(t *testing.T) {
+				var (
+					heights []int64
+					page    = Page{Limit: 4}
+				)
+				for {
+					parts, next, err := s.Participations(ctx, tc.filter, page)
+					if err != nil {
+						t.Fatalf("cannot query participations: %s", err)
+					}
+					for _, p := range parts {
+						heights = append(heights, p.BlockHeight)
+						if p.Status != tc.want[p.BlockHeight] {
+							t.Errorf("block %d: want %s, got %s", p.BlockHeight, tc.want[p.BlockHeight], p.Status)
+						}
+						wantProposer := ids[0]
+						if p.BlockHeight == 2 || p.BlockHeight == 5 {
+							wantProposer = ids[1]
+						}
+						if p.ProposerID != wantProposer {
+							t.Errorf("block %d: want proposer %d, got %d", p.BlockHeight, wantProposer, p.ProposerID)
+						}
+					}
+					if next == "" {
+						break
+					}
+					page.Cursor = next
+				}
+				if !reflect.DeepEqual(heights, tc.wantHeights) {
+					t.Fatalf("want heights %v, got %v", tc.wantHeights, heights)
+				}
+			})
+		}
+	})
+}
+
+func TestStoreValidatorAddresses(t *testing.T) {
+	eachStore(t, func(t *testing.T, s BlockStore) {
+		ctx := context.Background()
+		ids := insertQueryFixture(t, s)
+
+		got, err := s.ValidatorAddresses(ctx, []int64{ids[0], ids[2], 999})
+		if err != nil {
+			t.Fatalf("cannot get addresses: %s", err)
+		}
+		want := map[int64][]byte{ids[0]: {0x01}, ids[2]: {0x03}}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("want %x, got %x", want, got)
+		}
+	})
+}
+
+// insertQueryFixture inserts three validators and six blocks, one minute
+// apart, and returns the validator IDs.
+//
+// Block 2 was proposed by the second validator, which did not sign it. Block
+// 4 was not signed by the third validator and the second one voted nil.
+// Block 5 was proposed by the second validator. Blocks 1, 3 and 5 contain
+// transactions.
+func insertQueryFixture(t *testing.T, s BlockStore) []int64 {
+	t.Helper()
+	ctx := context.Background()
+
+	var ids []int64
+	for i := byte(1); i <= 3; i++ {
+		id, err := s.InsertValidator(ctx, []byte{i, 0, i}, []byte{i})
+		if err != nil {
+			t.Fatalf("cannot create a validator: %s", err)
+		}
+		ids = append(ids, id)
+	}
+
+	send := func(height byte, index byte) Transaction {
+		return Transaction{
+			Hash:     []byte{height, index},
+			Message:  "{}",
+			Messages: []Message{{Path: "cash/send", Details: `{}`}},
+		}
+	}
+	baseTime := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := int64(1); i <= 6; i++ {
+		b := Block{
+			Height:         i,
+			Hash:           []byte{0, 1, byte(i)},
+			Time:           baseTime.Add(time.Duration(i-1) * time.Minute),
+			ProposerID:     ids[0],
+			ParticipantIDs: []int64{ids[0], ids[1], ids[2]},
+			Messages:       []string{},
+		}
+		switch i {
+		case 1:
+			b.Transactions = []Transaction{send(0x01, 0)}
+		case 2:
+			b.ProposerID = ids[1]
+			b.ParticipantIDs = []int64{ids[0], ids[2]}
+			b.MissingIDs = []int64{ids[1]}
+		case 3:
+			b.Transactions = []Transaction{
+				send(0x03, 0),
+				{
+					Hash:    []byte{0x03, 1},
+					Message: `{"multi":true}`,
+					Fee:     coin.NewCoinp(0, 5, "IOV"),
+					Messages: []Message{
+						{Path: "username/register", Details: `{"a": 1}`},
+						{Path: "multisig/create", Details: `{"b": 2}`},
+					},
+				},
 			}
-		})
+		case 4:
+			b.ParticipantIDs = []int64{ids[0]}
+			b.MissingIDs = []int64{ids[2]}
+			b.NilVoteIDs = []int64{ids[1]}
+		case 5:
+			b.ProposerID = ids[1]
+			b.Transactions = []Transaction{send(0x05, 0), {Hash: []byte{0x05, 1}, Message: "{}"}}
+		}
+		if err := s.InsertBlock(ctx, b); err != nil {
+			t.Fatalf("cannot insert block %d: %s", i, err)
+		}
 	}
+	return ids
+}
+
+// eachStore runs given test with every BlockStore implementation. Each run
+// gets a new, empty store.
+func eachStore(t *testing.T, test func(t *testing.T, s BlockStore)) {
+	t.Run("postgres", func(t *testing.T) {
+		db, cleanup := ensureDB(t)
+		defer cleanup()
+		test(t, NewStore(db))
+	})
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemStore())
+	})
 }
 
 // ensureDB connects to a Postgres instance creates a database and returns a
@@ -269,8 +874,8 @@ func ensureDB(t *testing.T) (testdb *sql.DB, cleanup func()) {
 		t.Fatalf("cannot ping test database: %s", err)
 	}
 
-	if err := EnsureSchema(testdb); err != nil {
-		t.Fatalf("cannot ensure schema: %s", err)
+	if _, err := MigrateUp(context.Background(), testdb, LatestSchemaVersion()); err != nil {
+		t.Fatalf("cannot migrate schema: %s", err)
 	}
 
 	cleanup = func() {
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/iov-one/block-metrics/pkg/errors"
+	"github.com/iov-one/weave/coin"
 	"github.com/lib/pq"
 )
 
@@ -55,9 +56,9 @@ func (s *Store) InsertBlock(ctx context.Context, b Block) error {
 	defer tx.Rollback()
 
 	_, err = tx.ExecContext(ctx, `
-		INSERT INTO blocks (block_height, block_hash, block_time, proposer_id, messages, fee_frac)
-		VALUES ($1, $2, $3, $4, $5, $6)
-	`, b.Height, b.Hash, b.Time.UTC(), b.ProposerID, pq.Array(b.Messages), b.FeeFrac)
+		INSERT INTO blocks (block_height, block_hash, block_time, proposer_id, messages, fee_frac, validators_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, b.Height, b.Hash, b.Time.UTC(), b.ProposerID, pq.Array(b.Messages), b.FeeFrac, b.ValidatorsHash)
 	if err != nil {
 		return wrapPgErr(err, "insert block")
 	}
@@ -82,19 +83,265 @@ func (s *Store) InsertBlock(ctx context.Context, b Block) error {
 		}
 	}
 
+	for _, nilVote := range b.NilVoteIDs {
+		_, err = tx.ExecContext(ctx, `
+		INSERT INTO block_participations (validated, nil_vote, block_id, validator_id)
+		VALUES (false, true, $1, $2)
+		`, b.Height, nilVote)
+		if err != nil {
+			return wrapPgErr(err, "insert block participant")
+		}
+	}
+
+	for _, fee := range b.Fees {
+		_, err = tx.ExecContext(ctx, `
+		INSERT INTO block_fees (block_id, ticker, whole, fractional)
+		VALUES ($1, $2, $3, $4)
+		`, b.Height, fee.Ticker, fee.Whole, fee.Fractional)
+		if err != nil {
+			return wrapPgErr(err, "insert block fee")
+		}
+	}
+
 	for _, transaction := range b.Transactions {
-		_, err := tx.ExecContext(ctx, `
-		INSERT INTO transactions(transaction_hash, block_id, message)
-		VALUES($1, $2, $3)`, transaction.Hash, b.Height, transaction.Message)
+		var txID int64
+		ticker, whole, fractional := feeColumns(transaction.Fee)
+		err := tx.QueryRowContext(ctx, `
+		INSERT INTO transactions(transaction_hash, block_id, message, fee_ticker, fee_whole, fee_fractional)
+		VALUES($1, $2, $3, $4, $5, $6)
+		RETURNING id`, transaction.Hash, b.Height, transaction.Message, ticker, whole, fractional).Scan(&txID)
 		if err != nil {
 			return wrapPgErr(err, "insert transaction")
 		}
+
+		for i, msg := range transaction.Messages {
+			_, err := tx.ExecContext(ctx, `
+			INSERT INTO messages (transaction_id, message_index, path, details)
+			VALUES ($1, $2, $3, $4)`, txID, i, msg.Path, msg.Details)
+			if err != nil {
+				return wrapPgErr(err, "insert message")
+			}
+		}
 	}
 
 	err = tx.Commit()
 	return wrapPgErr(err, "commit block tx")
 }
 
+// InsertBlocks adds all given blocks into the database within a single
+// transaction. This is much faster than inserting blocks one by one, because
+// all rows are streamed using the COPY protocol.
+// This method returns ErrConflict if any of the blocks cannot be inserted due
+// to conflicting data. In such case none of the blocks is inserted.
+func (s *Store) InsertBlocks(ctx context.Context, blocks []Block) error {
+	var (
+		blockRows       [][]interface{}
+		participantRows [][]interface{}
+		feeRows         [][]interface{}
+		transactionRows [][]interface{}
+		messageRows     [][]interface{}
+		transactionsCnt int
+	)
+	for _, b := range blocks {
+		if len(b.ParticipantIDs) == 0 {
+			return errors.Wrapf(ErrConflict, "no participants on block %d", b.Height)
+		}
+		blockRows = append(blockRows, []interface{}{
+			b.Height, b.Hash, b.Time.UTC(), b.ProposerID, pq.Array(b.Messages), b.FeeFrac, b.ValidatorsHash,
+		})
+		for _, part := range b.ParticipantIDs {
+			participantRows = append(participantRows, []interface{}{true, false, b.Height, part})
+		}
+		for _, missed := range b.MissingIDs {
+			participantRows = append(participantRows, []interface{}{false, false, b.Height, missed})
+		}
+		for _, nilVote := range b.NilVoteIDs {
+			participantRows = append(participantRows, []interface{}{false, true, b.Height, nilVote})
+		}
+		for _, fee := range b.Fees {
+			feeRows = append(feeRows, []interface{}{b.Height, fee.Ticker, fee.Whole, fee.Fractional})
+		}
+		transactionsCnt += len(b.Transactions)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot create transaction")
+	}
+	defer tx.Rollback()
+
+	// Messages reference transactions, so transaction IDs must be known
+	// upfront. COPY cannot return generated values.
+	transactionIDs, err := nextIDs(ctx, tx, "transactions", transactionsCnt)
+	if err != nil {
+		return errors.Wrap(err, "transaction IDs")
+	}
+	for _, b := range blocks {
+		for _, transaction := range b.Transactions {
+			id := transactionIDs[0]
+			transactionIDs = transactionIDs[1:]
+
+			ticker, whole, fractional := feeColumns(transaction.Fee)
+			transactionRows = append(transactionRows, []interface{}{
+				id, transaction.Hash, b.Height, transaction.Message, ticker, whole, fractional,
+			})
+			for i, msg := range transaction.Messages {
+				messageRows = append(messageRows, []interface{}{id, i, msg.Path, msg.Details})
+			}
+		}
+	}
+
+	err = copyRows(ctx, tx, "blocks",
+		[]string{"block_height", "block_hash", "block_time", "proposer_id", "messages", "fee_frac", "validators_hash"},
+		blockRows)
+	if err != nil {
+		return errors.Wrap(err, "copy blocks")
+	}
+
+	err = copyRows(ctx, tx, "block_participations",
+		[]string{"validated", "nil_vote", "block_id", "validator_id"},
+		participantRows)
+	if err != nil {
+		return errors.Wrap(err, "copy block participants")
+	}
+
+	err = copyRows(ctx, tx, "block_fees",
+		[]string{"block_id", "ticker", "whole", "fractional"},
+		feeRows)
+	if err != nil {
+		return errors.Wrap(err, "copy block fees")
+	}
+
+	err = copyRows(ctx, tx, "transactions",
+		[]string{"id", "transaction_hash", "block_id", "message", "fee_ticker", "fee_whole", "fee_fractional"},
+		transactionRows)
+	if err != nil {
+		return errors.Wrap(err, "copy transactions")
+	}
+
+	err = copyRows(ctx, tx, "messages",
+		[]string{"transaction_id", "message_index", "path", "details"},
+		messageRows)
+	if err != nil {
+		return errors.Wrap(err, "copy messages")
+	}
+
+	err = tx.Commit()
+	return wrapPgErr(err, "commit blocks tx")
+}
+
+// InsertValidatorSet adds the validator set identified by given hash, as seen
+// first at given height. Set that is already present is not modified.
+func (s *Store) InsertValidatorSet(ctx context.Context, hash []byte, firstHeight int64, members []ValidatorSetMember) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot create transaction")
+	}
+	defer tx.Rollback()
+
+	for _, m := range members {
+		_, err := tx.ExecContext(ctx, `
+		INSERT INTO validator_sets (validators_hash, validator_id, voting_power, proposer_priority, first_height)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (validators_hash, validator_id) DO NOTHING
+		`, hash, m.ValidatorID, m.VotingPower, m.ProposerPriority, firstHeight)
+		if err != nil {
+			return wrapPgErr(err, "insert validator set member")
+		}
+	}
+
+	err = tx.Commit()
+	return wrapPgErr(err, "commit validator set tx")
+}
+
+// LoadValidatorSet returns all members of the validator set identified by
+// given hash, ordered by the voting power, highest first. This method returns
+// ErrNotFound if no such set exists.
+func (s *Store) LoadValidatorSet(ctx context.Context, hash []byte) ([]ValidatorSetMember, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT validator_id, voting_power, proposer_priority
+		FROM validator_sets
+		WHERE validators_hash = $1
+		ORDER BY voting_power DESC, validator_id
+	`, hash)
+	if err != nil {
+		return nil, wrapPgErr(err, "query validator set")
+	}
+	defer rows.Close()
+
+	var members []ValidatorSetMember
+	for rows.Next() {
+		var m ValidatorSetMember
+		if err := rows.Scan(&m.ValidatorID, &m.VotingPower, &m.ProposerPriority); err != nil {
+			return nil, wrapPgErr(err, "scan validator set member")
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapPgErr(err, "validator set rows")
+	}
+	if len(members) == 0 {
+		return nil, errors.Wrapf(ErrNotFound, "validator set %X", hash)
+	}
+	return members, nil
+}
+
+// nextIDs allocates n values from the sequence of the given table's id column.
+func nextIDs(ctx context.Context, tx *sql.Tx, table string, n int) ([]int64, error) {
+	if n == 0 {
+		return nil, nil
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT nextval(pg_get_serial_sequence($1, 'id'))
+		FROM generate_series(1, $2)
+	`, table, n)
+	if err != nil {
+		return nil, wrapPgErr(err, "query sequence")
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0, n)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, wrapPgErr(err, "scanning sequence")
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapPgErr(err, "scanning sequence")
+	}
+	if len(ids) != n {
+		return nil, errors.Wrapf(ErrNotFound, "want %d IDs, got %d", n, len(ids))
+	}
+	return ids, nil
+}
+
+// copyRows streams all rows into the given table using the COPY protocol.
+func copyRows(ctx context.Context, tx *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		return wrapPgErr(err, "prepare copy")
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			return wrapPgErr(err, "copy row")
+		}
+	}
+	// Calling Exec without arguments flushes all buffered rows.
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return wrapPgErr(err, "flush copy")
+	}
+	return wrapPgErr(stmt.Close(), "close copy")
+}
+
 // LatestBlock returns the block with the greatest high value. This method
 // returns ErrNotFound if no block exist.
 // Note that it doesn't load the validators by default
@@ -102,16 +349,20 @@ func (s *Store) LatestBlock(ctx context.Context) (*Block, error) {
 	var b Block
 
 	err := s.db.QueryRowContext(ctx, `
-		SELECT block_height, block_hash, block_time, proposer_id, messages, fee_frac
+		SELECT block_height, block_hash, block_time, proposer_id, messages, fee_frac, validators_hash
 		FROM blocks
 		ORDER BY block_height DESC
 		LIMIT 1
-	`).Scan(&b.Height, &b.Hash, &b.Time, &b.ProposerID, pq.Array(&b.Messages), &b.FeeFrac)
+	`).Scan(&b.Height, &b.Hash, &b.Time, &b.ProposerID, pq.Array(&b.Messages), &b.FeeFrac, &b.ValidatorsHash)
 
 	if err == nil {
 		// normalize it here, as not always stored like this in the db
 		b.Time = b.Time.UTC()
-		b.ParticipantIDs, b.MissingIDs, err = s.loadParticipants(ctx, b.Height)
+		b.ParticipantIDs, b.MissingIDs, b.NilVoteIDs, err = s.loadParticipants(ctx, b.Height)
+		if err != nil {
+			return nil, err
+		}
+		b.Fees, err = s.loadFees(ctx, b.Height)
 		return &b, err
 	}
 
@@ -131,15 +382,19 @@ func (s *Store) LoadBlock(ctx context.Context, blockHeight int64) (*Block, error
 	var b Block
 
 	err := s.db.QueryRowContext(ctx, `
-		SELECT block_height, block_hash, block_time, proposer_id, messages, fee_frac
+		SELECT block_height, block_hash, block_time, proposer_id, messages, fee_frac, validators_hash
 		FROM blocks
 		WHERE block_height = $1
-	`, blockHeight).Scan(&b.Height, &b.Hash, &b.Time, &b.ProposerID, pq.Array(&b.Messages), &b.FeeFrac)
+	`, blockHeight).Scan(&b.Height, &b.Hash, &b.Time, &b.ProposerID, pq.Array(&b.Messages), &b.FeeFrac, &b.ValidatorsHash)
 
 	if err == nil {
 		// normalize it here, as not always stored like this in the db
 		b.Time = b.Time.UTC()
-		b.ParticipantIDs, b.MissingIDs, err = s.loadParticipants(ctx, b.Height)
+		b.ParticipantIDs, b.MissingIDs, b.NilVoteIDs, err = s.loadParticipants(ctx, b.Height)
+		if err != nil {
+			return nil, err
+		}
+		b.Fees, err = s.loadFees(ctx, b.Height)
 		return &b, err
 	}
 
@@ -150,11 +405,114 @@ func (s *Store) LoadBlock(ctx context.Context, blockHeight int64) (*Block, error
 	return nil, errors.Wrap(castPgErr(err), "cannot select block")
 }
 
+// DeleteBlocksAbove removes all blocks with the height greater than the given
+// one, together with all their participations and transactions. All changes
+// are done within a single transaction. It returns the number of deleted
+// blocks.
+func (s *Store) DeleteBlocksAbove(ctx context.Context, blockHeight int64) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot create transaction")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM messages WHERE transaction_id IN (
+			SELECT id FROM transactions WHERE block_id > $1
+		)
+	`, blockHeight); err != nil {
+		return 0, wrapPgErr(err, "delete messages")
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM transactions WHERE block_id > $1
+	`, blockHeight); err != nil {
+		return 0, wrapPgErr(err, "delete transactions")
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM block_fees WHERE block_id > $1
+	`, blockHeight); err != nil {
+		return 0, wrapPgErr(err, "delete block fees")
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM block_participations WHERE block_id > $1
+	`, blockHeight); err != nil {
+		return 0, wrapPgErr(err, "delete block participations")
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		DELETE FROM blocks WHERE block_height > $1
+	`, blockHeight)
+	if err != nil {
+		return 0, wrapPgErr(err, "delete blocks")
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, wrapPgErr(err, "deleted blocks count")
+	}
+
+	err = tx.Commit()
+	return deleted, wrapPgErr(err, "commit delete tx")
+}
+
+// UpdateSyncState writes the synchronization progress into the database,
+// replacing the previously stored state.
+func (s *Store) UpdateSyncState(ctx context.Context, state SyncState) error {
+	var stoppedAt interface{}
+	if state.StoppedAt != nil {
+		stoppedAt = state.StoppedAt.UTC()
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO sync_state (id, node_uri, synced_height, chain_height, last_error, started_at, updated_at, stopped_at)
+		VALUES (1, $1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id) DO UPDATE SET
+			node_uri = EXCLUDED.node_uri,
+			synced_height = EXCLUDED.synced_height,
+			chain_height = EXCLUDED.chain_height,
+			last_error = EXCLUDED.last_error,
+			started_at = EXCLUDED.started_at,
+			updated_at = EXCLUDED.updated_at,
+			stopped_at = EXCLUDED.stopped_at
+	`, state.NodeURI, state.SyncedHeight, state.ChainHeight, state.LastError,
+		state.StartedAt.UTC(), state.UpdatedAt.UTC(), stoppedAt)
+	return wrapPgErr(err, "upsert sync state")
+}
+
+// LoadSyncState returns the synchronization progress as last written to the
+// database. This method returns ErrNotFound if no state was written yet.
+func (s *Store) LoadSyncState(ctx context.Context) (*SyncState, error) {
+	var (
+		state     SyncState
+		stoppedAt pq.NullTime
+	)
+	err := s.db.QueryRowContext(ctx, `
+		SELECT node_uri, synced_height, chain_height, last_error, started_at, updated_at, stopped_at
+		FROM sync_state
+		WHERE id = 1
+	`).Scan(&state.NodeURI, &state.SyncedHeight, &state.ChainHeight, &state.LastError,
+		&state.StartedAt, &state.UpdatedAt, &stoppedAt)
+	if err != nil {
+		return nil, wrapPgErr(err, "select sync state")
+	}
+
+	// normalize it here, as not always stored like this in the db
+	state.StartedAt = state.StartedAt.UTC()
+	state.UpdatedAt = state.UpdatedAt.UTC()
+	if stoppedAt.Valid {
+		t := stoppedAt.Time.UTC()
+		state.StoppedAt = &t
+	}
+	return &state, nil
+}
+
 // loadParticipants will load the participants for the given block and update the structure.
-// Automatically called as part of Load/LatestBlock to give you the full info
-func (s *Store) loadParticipants(ctx context.Context, blockHeight int64) (participants []int64, missing []int64, err error) {
+// Validators that voted for nil are returned separately from the ones that
+// did not vote at all.
+func (s *Store) loadParticipants(ctx context.Context, blockHeight int64) (participants, missing, nilVotes []int64, err error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT validator_id, validated
+		SELECT validator_id, validated, nil_vote
 		FROM block_participations
 		WHERE block_id = $1
 	`, blockHeight)
@@ -166,14 +524,17 @@ func (s *Store) loadParticipants(ctx context.Context, blockHeight int64) (partic
 
 	for rows.Next() {
 		var pid int64
-		var validated bool
-		if err = rows.Scan(&pid, &validated); err != nil {
+		var validated, nilVote bool
+		if err = rows.Scan(&pid, &validated, &nilVote); err != nil {
 			err = wrapPgErr(rows.Err(), "scanning participants")
 			return
 		}
-		if validated {
+		switch {
+		case validated:
 			participants = append(participants, pid)
-		} else {
+		case nilVote:
+			nilVotes = append(nilVotes, pid)
+		default:
 			missing = append(missing, pid)
 		}
 	}
@@ -182,6 +543,40 @@ func (s *Store) loadParticipants(ctx context.Context, blockHeight int64) (partic
 	return
 }
 
+// loadFees returns the total fees collected in the given block, one coin per
+// ticker. Automatically called as part of Load/LatestBlock.
+func (s *Store) loadFees(ctx context.Context, blockHeight int64) (coin.Coins, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT ticker, whole, fractional
+		FROM block_fees
+		WHERE block_id = $1
+		ORDER BY ticker
+	`, blockHeight)
+	if err != nil {
+		return nil, wrapPgErr(err, "query fees")
+	}
+	defer rows.Close()
+
+	var fees coin.Coins
+	for rows.Next() {
+		var c coin.Coin
+		if err := rows.Scan(&c.Ticker, &c.Whole, &c.Fractional); err != nil {
+			return nil, wrapPgErr(err, "scanning fees")
+		}
+		fees = append(fees, &c)
+	}
+	return fees, wrapPgErr(rows.Err(), "scanning fees")
+}
+
+// feeColumns returns the values of the transaction fee columns. All values
+// are nil if there is no fee.
+func feeColumns(fee *coin.Coin) (ticker, whole, fractional interface{}) {
+	if fee == nil {
+		return nil, nil, nil
+	}
+	return fee.Ticker, fee.Whole, fee.Fractional
+}
+
 type Block struct {
 	Height         int64
 	Hash           []byte
@@ -190,13 +585,60 @@ type Block struct {
 	ParticipantIDs []int64
 	MissingIDs     []int64
 	Messages       []string
-	FeeFrac        uint64
-	Transactions   []Transaction
+	// FeeFrac is the total of IOV fees paid in the block, in fractional
+	// units. Use Fees for all currencies.
+	FeeFrac uint64
+	// Fees holds the total fees paid in the block, one coin per ticker.
+	Fees         coin.Coins
+	Transactions []Transaction
+	// ValidatorsHash identifies the validator set of the block. Details
+	// of the set can be loaded using LoadValidatorSet.
+	ValidatorsHash []byte
+	// NilVoteIDs are the validators that voted, but not for this block.
+	// They are not included in MissingIDs.
+	NilVoteIDs []int64
+}
+
+// ValidatorSetMember is a validator that is a part of a validator set.
+type ValidatorSetMember struct {
+	ValidatorID int64
+	VotingPower int64
+	// ProposerPriority changes with every block. Value as of the first
+	// block with the set is stored.
+	ProposerPriority int64
 }
 
 type Transaction struct {
 	Hash    []byte
 	Message string
+	// Fee is the fee paid for the transaction or nil if none was paid.
+	Fee *coin.Coin
+	// Messages holds all messages carried by the transaction. A batch
+	// message is represented by the messages it contains.
+	Messages []Message
+}
+
+// SyncState describes the progress of the blocks synchronization.
+type SyncState struct {
+	// NodeURI is the address of the tendermint node used.
+	NodeURI string
+	// SyncedHeight is the height of the last block inserted.
+	SyncedHeight int64
+	// ChainHeight is the height of the chain head as last seen.
+	ChainHeight int64
+	// LastError is the reason why the last synchronization stopped.
+	LastError string
+	StartedAt time.Time
+	UpdatedAt time.Time
+	// StoppedAt is nil while the synchronization is running.
+	StoppedAt *time.Time
+}
+
+// Message is a single message carried by a transaction.
+type Message struct {
+	Path string `json:"path"`
+	// Details is the JSON serialized message.
+	Details string `json:"details"`
 }
 
 var (
@@ -207,6 +649,10 @@ var (
 	// ErrConflict is returned when an operation cannot be completed
 	// because of database constraints.
 	ErrConflict = errors.New("conflict")
+
+	// ErrInvalid is returned when a query cannot be made because of
+	// invalid parameters, for example a malformed page cursor.
+	ErrInvalid = errors.New("invalid")
 )
 
 func wrapPgErr(err error, msg string) error {
@@ -0,0 +1,626 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iov-one/block-metrics/pkg/errors"
+	"github.com/iov-one/weave/coin"
+	"github.com/lib/pq"
+)
+
+const (
+	// defaultPageLimit is the number of results returned when the page
+	// limit is not set.
+	defaultPageLimit = 50
+	// maxPageLimit is the greatest number of results that can be returned
+	// at once.
+	maxPageLimit = 500
+)
+
+// Page selects a part of a query result. Results are returned in a stable
+// order, so that all of them can be iterated over by passing the cursor
+// returned with one page to the query of the next page.
+type Page struct {
+	// Cursor is the value returned together with the previous page.
+	// First page is returned if empty.
+	Cursor string
+	// Limit is the maximum number of results returned. A default is used
+	// if zero. Values greater than the maximum are lowered.
+	Limit int
+}
+
+// parse returns the key that the cursor points to and the page limit. The
+// key is zero if there is no cursor.
+func (p Page) parse() (after int64, limit int, err error) {
+	switch {
+	case p.Limit < 0:
+		return 0, 0, errors.Wrapf(ErrInvalid, "page limit %d", p.Limit)
+	case p.Limit == 0:
+		limit = defaultPageLimit
+	case p.Limit > maxPageLimit:
+		limit = maxPageLimit
+	default:
+		limit = p.Limit
+	}
+	if p.Cursor == "" {
+		return 0, limit, nil
+	}
+	after, err = strconv.ParseInt(p.Cursor, 10, 64)
+	if err != nil || after <= 0 {
+		return 0, 0, errors.Wrapf(ErrInvalid, "cursor %q", p.Cursor)
+	}
+	return after, limit, nil
+}
+
+// pageCursor returns the cursor pointing after given key.
+func pageCursor(key int64) string {
+	return strconv.FormatInt(key, 10)
+}
+
+// BlockFilter selects blocks. Zero value fields are ignored.
+type BlockFilter struct {
+	// FromHeight and ToHeight limit the block heights, both inclusive.
+	FromHeight int64
+	ToHeight   int64
+	// FromTime is inclusive and ToTime is exclusive.
+	FromTime time.Time
+	ToTime   time.Time
+	// ProposerID selects blocks proposed by given validator.
+	ProposerID int64
+	// HasMissed selects blocks that at least one validator did not
+	// precommit. Nil votes are not considered missed.
+	HasMissed bool
+}
+
+// TransactionFilter selects transactions. Zero value fields are ignored.
+type TransactionFilter struct {
+	Hash []byte
+	// MessagePath selects transactions that carry at least one message
+	// with given path, for example "cash/send".
+	MessagePath string
+	// FromHeight and ToHeight limit the heights of the blocks that
+	// include the transactions, both inclusive.
+	FromHeight int64
+	ToHeight   int64
+}
+
+// BlockTransaction is a transaction together with the height of the block
+// it was included in.
+type BlockTransaction struct {
+	BlockHeight int64
+	Transaction
+}
+
+// ValidatorFilter selects validators and the range of blocks that their
+// participation is counted over. Zero value fields are ignored.
+type ValidatorFilter struct {
+	Address []byte
+	// FromHeight and ToHeight limit the blocks counted, both inclusive.
+	FromHeight int64
+	ToHeight   int64
+}
+
+// ValidatorStats is a validator with the count of the blocks it took part in.
+type ValidatorStats struct {
+	ID        int64
+	Address   []byte
+	PublicKey []byte
+	// Signed is the number of blocks that the validator precommitted.
+	Signed int64
+	// Missed is the number of blocks that the validator was expected to
+	// precommit, but did not vote at all.
+	Missed int64
+	// NilVotes is the number of blocks that the validator voted nil for.
+	NilVotes int64
+}
+
+// ParticipationFilter selects the blocks that a validator was expected to
+// precommit. Zero value fields other than ValidatorID are ignored.
+type ParticipationFilter struct {
+	ValidatorID int64
+	// FromHeight and ToHeight limit the block heights, both inclusive.
+	FromHeight int64
+	ToHeight   int64
+	// Missed selects only the blocks that the validator did not vote
+	// for at all.
+	Missed bool
+}
+
+// Participation describes how a validator took part in a block.
+type Participation struct {
+	BlockHeight int64
+	BlockTime   time.Time
+	ProposerID  int64
+	Status      ParticipationStatus
+}
+
+// ParticipationStatus is the vote of a validator for a block.
+type ParticipationStatus int
+
+const (
+	// Signed means that the validator precommitted the block.
+	Signed ParticipationStatus = iota
+	// Missed means that the validator did not vote.
+	Missed
+	// NilVote means that the validator voted, but not for the block.
+	NilVote
+)
+
+func (s ParticipationStatus) String() string {
+	switch s {
+	case Signed:
+		return "signed"
+	case Missed:
+		return "missed"
+	case NilVote:
+		return "nil_vote"
+	}
+	return "unknown"
+}
+
+// conditions collects SQL conditions together with their positional
+// arguments.
+type conditions struct {
+	where []string
+	args  []interface{}
+}
+
+// add appends a condition. Each ? in the condition is replaced with the
+// placeholder of the next of given arguments.
+func (c *conditions) add(cond string, args ...interface{}) {
+	for _, a := range args {
+		c.args = append(c.args, a)
+		cond = strings.Replace(cond, "?", "$"+strconv.Itoa(len(c.args)), 1)
+	}
+	c.where = append(c.where, cond)
+}
+
+// arg returns the placeholder of given argument.
+func (c *conditions) arg(a interface{}) string {
+	c.args = append(c.args, a)
+	return "$" + strconv.Itoa(len(c.args))
+}
+
+func (c *conditions) sql() string {
+	if len(c.where) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(c.where, " AND ")
+}
+
+// Blocks returns blocks matching given filter, the highest first. The cursor
+// of the next page is empty if there are no more results.
+func (s *Store) Blocks(ctx context.Context, f BlockFilter, p Page) ([]*Block, string, error) {
+	after, limit, err := p.parse()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var c conditions
+	if after != 0 {
+		c.add("block_height < ?", after)
+	}
+	if f.FromHeight != 0 {
+		c.add("block_height >= ?", f.FromHeight)
+	}
+	if f.ToHeight != 0 {
+		c.add("block_height <= ?", f.ToHeight)
+	}
+	if !f.FromTime.IsZero() {
+		c.add("block_time >= ?", f.FromTime.UTC())
+	}
+	if !f.ToTime.IsZero() {
+		c.add("block_time < ?", f.ToTime.UTC())
+	}
+	if f.ProposerID != 0 {
+		c.add("proposer_id = ?", f.ProposerID)
+	}
+	if f.HasMissed {
+		c.add(`EXISTS (
+			SELECT 1 FROM block_participations p
+			WHERE p.block_id = block_height AND NOT p.validated AND NOT p.nil_vote
+		)`)
+	}
+	query := `
+		SELECT block_height, block_hash, block_time, proposer_id, messages, fee_frac, validators_hash
+		FROM blocks` + c.sql() + `
+		ORDER BY block_height DESC
+		LIMIT ` + c.arg(limit+1)
+
+	rows, err := s.db.QueryContext(ctx, query, c.args...)
+	if err != nil {
+		return nil, "", wrapPgErr(err, "query blocks")
+	}
+	defer rows.Close()
+
+	var blocks []*Block
+	for rows.Next() {
+		var b Block
+		err := rows.Scan(&b.Height, &b.Hash, &b.Time, &b.ProposerID, pq.Array(&b.Messages), &b.FeeFrac, &b.ValidatorsHash)
+		if err != nil {
+			return nil, "", wrapPgErr(err, "scanning blocks")
+		}
+		// normalize it here, as not always stored like this in the db
+		b.Time = b.Time.UTC()
+		blocks = append(blocks, &b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", wrapPgErr(err, "scanning blocks")
+	}
+	rows.Close()
+
+	var next string
+	if len(blocks) > limit {
+		blocks = blocks[:limit]
+		next = pageCursor(blocks[limit-1].Height)
+	}
+	if err := s.loadBlocksParticipants(ctx, blocks); err != nil {
+		return nil, "", err
+	}
+	if err := s.loadBlocksFees(ctx, blocks); err != nil {
+		return nil, "", err
+	}
+	return blocks, next, nil
+}
+
+// blockHeights returns the heights of all given blocks together with the
+// blocks indexed by their height.
+func blockHeights(blocks []*Block) ([]int64, map[int64]*Block) {
+	heights := make([]int64, 0, len(blocks))
+	byHeight := make(map[int64]*Block, len(blocks))
+	for _, b := range blocks {
+		heights = append(heights, b.Height)
+		byHeight[b.Height] = b
+	}
+	return heights, byHeight
+}
+
+// loadBlocksParticipants sets the participants, missing validators and nil
+// votes of all given blocks using a single query.
+func (s *Store) loadBlocksParticipants(ctx context.Context, blocks []*Block) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+	heights, byHeight := blockHeights(blocks)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT block_id, validator_id, validated, nil_vote
+		FROM block_participations
+		WHERE block_id = ANY($1)
+	`, pq.Array(heights))
+	if err != nil {
+		return wrapPgErr(err, "query participants")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			height, pid        int64
+			validated, nilVote bool
+		)
+		if err := rows.Scan(&height, &pid, &validated, &nilVote); err != nil {
+			return wrapPgErr(err, "scanning participants")
+		}
+		b := byHeight[height]
+		switch {
+		case validated:
+			b.ParticipantIDs = append(b.ParticipantIDs, pid)
+		case nilVote:
+			b.NilVoteIDs = append(b.NilVoteIDs, pid)
+		default:
+			b.MissingIDs = append(b.MissingIDs, pid)
+		}
+	}
+	return wrapPgErr(rows.Err(), "scanning participants")
+}
+
+// loadBlocksFees sets the fees of all given blocks using a single query.
+func (s *Store) loadBlocksFees(ctx context.Context, blocks []*Block) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+	heights, byHeight := blockHeights(blocks)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT block_id, ticker, whole, fractional
+		FROM block_fees
+		WHERE block_id = ANY($1)
+		ORDER BY block_id, ticker
+	`, pq.Array(heights))
+	if err != nil {
+		return wrapPgErr(err, "query fees")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			height int64
+			c      coin.Coin
+		)
+		if err := rows.Scan(&height, &c.Ticker, &c.Whole, &c.Fractional); err != nil {
+			return wrapPgErr(err, "scanning fees")
+		}
+		b := byHeight[height]
+		b.Fees = append(b.Fees, &c)
+	}
+	return wrapPgErr(rows.Err(), "scanning fees")
+}
+
+// Transactions returns transactions matching given filter, the most recent
+// first. The cursor of the next page is empty if there are no more results.
+func (s *Store) Transactions(ctx context.Context, f TransactionFilter, p Page) ([]*BlockTransaction, string, error) {
+	after, limit, err := p.parse()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Transactions are inserted in the order of blocks, so the ID
+	// order is the same as the height order.
+	var c conditions
+	if after != 0 {
+		c.add("t.id < ?", after)
+	}
+	if len(f.Hash) != 0 {
+		c.add("t.transaction_hash = ?", f.Hash)
+	}
+	if f.MessagePath != "" {
+		c.add(`EXISTS (
+			SELECT 1 FROM messages m
+			WHERE m.transaction_id = t.id AND m.path = ?
+		)`, f.MessagePath)
+	}
+	if f.FromHeight != 0 {
+		c.add("t.block_id >= ?", f.FromHeight)
+	}
+	if f.ToHeight != 0 {
+		c.add("t.block_id <= ?", f.ToHeight)
+	}
+	query := `
+		SELECT t.id, t.transaction_hash, t.block_id, t.message, t.fee_ticker, t.fee_whole, t.fee_fractional
+		FROM transactions t` + c.sql() + `
+		ORDER BY t.id DESC
+		LIMIT ` + c.arg(limit+1)
+
+	rows, err := s.db.QueryContext(ctx, query, c.args...)
+	if err != nil {
+		return nil, "", wrapPgErr(err, "query transactions")
+	}
+	defer rows.Close()
+
+	var (
+		ids []int64
+		txs []*BlockTransaction
+	)
+	for rows.Next() {
+		var (
+			id      int64
+			tx      BlockTransaction
+			message sql.NullString
+			ticker  sql.NullString
+			whole   sql.NullInt64
+			frac    sql.NullInt64
+		)
+		if err := rows.Scan(&id, &tx.Hash, &tx.BlockHeight, &message, &ticker, &whole, &frac); err != nil {
+			return nil, "", wrapPgErr(err, "scanning transactions")
+		}
+		tx.Message = message.String
+		if ticker.Valid {
+			tx.Fee = &coin.Coin{Ticker: ticker.String, Whole: whole.Int64, Fractional: frac.Int64}
+		}
+		ids = append(ids, id)
+		txs = append(txs, &tx)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", wrapPgErr(err, "scanning transactions")
+	}
+	rows.Close()
+
+	var next string
+	if len(txs) > limit {
+		txs, ids = txs[:limit], ids[:limit]
+		next = pageCursor(ids[limit-1])
+	}
+	if err := s.loadMessages(ctx, ids, txs); err != nil {
+		return nil, "", err
+	}
+	return txs, next, nil
+}
+
+// loadMessages sets the messages of all given transactions. IDs must be in
+// the same order as the transactions.
+func (s *Store) loadMessages(ctx context.Context, ids []int64, txs []*BlockTransaction) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	byID := make(map[int64]*BlockTransaction, len(ids))
+	for i, id := range ids {
+		byID[id] = txs[i]
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT transaction_id, path, details
+		FROM messages
+		WHERE transaction_id = ANY($1)
+		ORDER BY transaction_id, message_index
+	`, pq.Array(ids))
+	if err != nil {
+		return wrapPgErr(err, "query messages")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id  int64
+			msg Message
+		)
+		if err := rows.Scan(&id, &msg.Path, &msg.Details); err != nil {
+			return wrapPgErr(err, "scanning messages")
+		}
+		tx := byID[id]
+		tx.Messages = append(tx.Messages, msg)
+	}
+	return wrapPgErr(rows.Err(), "scanning messages")
+}
+
+// Validators returns validators matching given filter, ordered by ID, with
+// their participation counted over the blocks within the filter height range.
+// The cursor of the next page is empty if there are no more results.
+func (s *Store) Validators(ctx context.Context, f ValidatorFilter, p Page) ([]*ValidatorStats, string, error) {
+	after, limit, err := p.parse()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var join conditions
+	join.add("p.validator_id = v.id")
+	if f.FromHeight != 0 {
+		join.add("p.block_id >= ?", f.FromHeight)
+	}
+	if f.ToHeight != 0 {
+		join.add("p.block_id <= ?", f.ToHeight)
+	}
+	c := conditions{args: join.args}
+	if after != 0 {
+		c.add("v.id > ?", after)
+	}
+	if len(f.Address) != 0 {
+		c.add("v.address = ?", f.Address)
+	}
+	query := `
+		SELECT v.id, v.address, v.public_key,
+			COUNT(p.id) FILTER (WHERE p.validated),
+			COUNT(p.id) FILTER (WHERE NOT p.validated AND NOT p.nil_vote),
+			COUNT(p.id) FILTER (WHERE p.nil_vote)
+		FROM validators v
+		LEFT JOIN block_participations p ON ` + strings.Join(join.where, " AND ") + c.sql() + `
+		GROUP BY v.id
+		ORDER BY v.id
+		LIMIT ` + c.arg(limit+1)
+
+	rows, err := s.db.QueryContext(ctx, query, c.args...)
+	if err != nil {
+		return nil, "", wrapPgErr(err, "query validators")
+	}
+	defer rows.Close()
+
+	var validators []*ValidatorStats
+	for rows.Next() {
+		var v ValidatorStats
+		if err := rows.Scan(&v.ID, &v.Address, &v.PublicKey, &v.Signed, &v.Missed, &v.NilVotes); err != nil {
+			return nil, "", wrapPgErr(err, "scanning validators")
+		}
+		validators = append(validators, &v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", wrapPgErr(err, "scanning validators")
+	}
+
+	var next string
+	if len(validators) > limit {
+		validators = validators[:limit]
+		next = pageCursor(validators[limit-1].ID)
+	}
+	return validators, next, nil
+}
+
+// ValidatorAddresses returns the addresses of validators with given IDs.
+// Validators that do not exist are not included.
+func (s *Store) ValidatorAddresses(ctx context.Context, ids []int64) (map[int64][]byte, error) {
+	addresses := make(map[int64][]byte, len(ids))
+	if len(ids) == 0 {
+		return addresses, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, address FROM validators WHERE id = ANY($1)
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, wrapPgErr(err, "query validators")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id      int64
+			address []byte
+		)
+		if err := rows.Scan(&id, &address); err != nil {
+			return nil, wrapPgErr(err, "scanning validators")
+		}
+		addresses[id] = address
+	}
+	return addresses, wrapPgErr(rows.Err(), "scanning validators")
+}
+
+// Participations returns the participation of a validator in the blocks
+// matching given filter, the highest first. The cursor of the next page is
+// empty if there are no more results.
+func (s *Store) Participations(ctx context.Context, f ParticipationFilter, p Page) ([]*Participation, string, error) {
+	after, limit, err := p.parse()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var c conditions
+	c.add("p.validator_id = ?", f.ValidatorID)
+	if after != 0 {
+		c.add("p.block_id < ?", after)
+	}
+	if f.FromHeight != 0 {
+		c.add("p.block_id >= ?", f.FromHeight)
+	}
+	if f.ToHeight != 0 {
+		c.add("p.block_id <= ?", f.ToHeight)
+	}
+	if f.Missed {
+		c.add("NOT p.validated AND NOT p.nil_vote")
+	}
+	query := `
+		SELECT p.block_id, b.block_time, b.proposer_id, p.validated, p.nil_vote
+		FROM block_participations p
+			INNER JOIN blocks b ON b.block_height = p.block_id` + c.sql() + `
+		ORDER BY p.block_id DESC
+		LIMIT ` + c.arg(limit+1)
+
+	rows, err := s.db.QueryContext(ctx, query, c.args...)
+	if err != nil {
+		return nil, "", wrapPgErr(err, "query participations")
+	}
+	defer rows.Close()
+
+	var participations []*Participation
+	for rows.Next() {
+		var (
+			part             Participation
+			validated, isNil bool
+		)
+		if err := rows.Scan(&part.BlockHeight, &part.BlockTime, &part.ProposerID, &validated, &isNil); err != nil {
+			return nil, "", wrapPgErr(err, "scanning participations")
+		}
+		// normalize it here, as not always stored like this in the db
+		part.BlockTime = part.BlockTime.UTC()
+		switch {
+		case validated:
+			part.Status = Signed
+		case isNil:
+			part.Status = NilVote
+		default:
+			part.Status = Missed
+		}
+		participations = append(participations, &part)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", wrapPgErr(err, "scanning participations")
+	}
+
+	var next string
+	if len(participations) > limit {
+		participations = participations[:limit]
+		next = pageCursor(participations[limit-1].BlockHeight)
+	}
+	return participations, next, nil
+}
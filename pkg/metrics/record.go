@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/iov-one/block-metrics/pkg/errors"
+)
+
+// Recorder writes tendermint JSONRPC responses to a fixture directory, one
+// file per method and params combination. Recorded fixtures can be served
+// using TendermintReplay, which allows to reproduce a synchronization without
+// network access.
+//
+// Recorder is safe for concurrent use.
+type Recorder struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewRecorder returns a recorder that writes fixtures to given directory. The
+// directory is created if it does not exist.
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create fixture directory")
+	}
+	return &Recorder{dir: dir}, nil
+}
+
+// record writes the response to the fixture file. Existing fixture for the
+// same request is overwritten. Responses that were not received are not
+// recorded.
+func (r *Recorder) record(method string, params []string, resp *jsonrpcResponse) error {
+	if resp.err != nil {
+		return nil
+	}
+	raw, err := json.MarshalIndent(fixture{
+		Method: method,
+		Params: params,
+		Result: resp.Result,
+		Error:  resp.Error,
+	}, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "marshal fixture")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	path := filepath.Join(r.dir, fixtureName(method, params))
+	if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+		return errors.Wrap(err, "write fixture")
+	}
+	return nil
+}
+
+// fixture is the content of a single fixture file.
+type fixture struct {
+	Method string          `json:"method"`
+	Params []string        `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *jsonrpcError   `json:"error,omitempty"`
+}
+
+// fixtureName returns the name of the file that a response to given request
+// is stored in, for example commit-1234.json
+func fixtureName(method string, params []string) string {
+	name := strings.Join(append([]string{method}, params...), "-")
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	return name + ".json"
+}
+
+// TendermintReplay serves responses recorded by Recorder. It does not make any
+// network calls, so a request that was not recorded fails with
+// ErrNoFixture.
+type TendermintReplay struct {
+	dir string
+}
+
+var _ TendermintRPC = (*TendermintReplay)(nil)
+
+// NewTendermintReplay returns a client that serves fixtures from given
+// directory.
+func NewTendermintReplay(dir string) *TendermintReplay {
+	return &TendermintReplay{dir: dir}
+}
+
+// ErrNoFixture is returned by TendermintReplay when a response to the request
+// was not recorded.
+var ErrNoFixture = errors.New("no fixture")
+
+// DoContext serves the recorded response to the request.
+func (r *TendermintReplay) DoContext(ctx context.Context, method string, dest interface{}, args ...interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrapf(err, "%s request", method)
+	}
+
+	params := newJSONRPCRequest("", method, args).Params
+	name := fixtureName(method, params)
+	raw, err := ioutil.ReadFile(filepath.Join(r.dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.Wrap(ErrNoFixture, name)
+		}
+		return errors.Wrap(err, "read fixture")
+	}
+
+	var f fixture
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return errors.Wrapf(err, "cannot unmarshal fixture %s", name)
+	}
+	resp := jsonrpcResponse{Result: f.Result, Error: f.Error}
+	return resp.decode(dest)
+}
+
+// Close does nothing.
+func (r *TendermintReplay) Close() error {
+	return nil
+}
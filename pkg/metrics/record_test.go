@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iov-one/block-metrics/pkg/tmtest"
+	bnsd "github.com/iov-one/weave/cmd/bnsd/app"
+	"github.com/iov-one/weave/coin"
+	"github.com/iov-one/weave/x/cash"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatalf("cannot create fixture directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := tmtest.NewNode()
+	defer node.Close()
+	node.AddBlock(tmtest.Block{
+		Time: time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC),
+		Validators: []tmtest.Validator{
+			{Address: []byte{0x01}, PubKey: []byte{0x11}, VotingPower: 1},
+			{Address: []byte{0x02}, PubKey: []byte{0x22}, VotingPower: 1},
+		},
+		Signers: [][]byte{{0x02}},
+		Txs: []*bnsd.Tx{
+			{Sum: &bnsd.Tx_CashSendMsg{CashSendMsg: &cash.SendMsg{
+				Source:      []byte{0x01},
+				Destination: []byte{0x02},
+				Amount:      coin.NewCoinp(1, 0, "IOV"),
+			}}},
+		},
+	})
+
+	tmc, err := DialTendermint(node.URL())
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer tmc.Close()
+	rec, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatalf("cannot create recorder: %s", err)
+	}
+	tmc.Record(rec)
+
+	ctx := context.Background()
+	wantCommit, err := Commit(ctx, tmc, 1)
+	if err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	wantBlock, err := FetchBlock(ctx, tmc, 1)
+	if err != nil {
+		t.Fatalf("block: %s", err)
+	}
+	if _, err := FetchBlock(ctx, tmc, 2); !ErrHeightNotAvailable.Is(err) {
+		t.Fatalf("want height not available error, got %v", err)
+	}
+
+	// Replay must not depend on the node.
+	node.Close()
+	replay := NewTendermintReplay(dir)
+
+	commit, err := Commit(ctx, replay, 1)
+	if err != nil {
+		t.Fatalf("replay commit: %s", err)
+	}
+	if !reflect.DeepEqual(commit, wantCommit) {
+		t.Logf(" got %#v", commit)
+		t.Logf("want %#v", wantCommit)
+		t.Fatal("unexpected commit")
+	}
+	block, err := FetchBlock(ctx, replay, 1)
+	if err != nil {
+		t.Fatalf("replay block: %s", err)
+	}
+	if !reflect.DeepEqual(block, wantBlock) {
+		t.Logf(" got %#v", block)
+		t.Logf("want %#v", wantBlock)
+		t.Fatal("unexpected block")
+	}
+	if _, err := FetchBlock(ctx, replay, 2); !ErrHeightNotAvailable.Is(err) {
+		t.Fatalf("want recorded height not available error, got %v", err)
+	}
+	if _, err := Validators(ctx, replay, 1); !ErrNoFixture.Is(err) {
+		t.Fatalf("want no fixture error, got %v", err)
+	}
+}
+
+func TestFixtureName(t *testing.T) {
+	cases := map[string]struct {
+		method string
+		params []string
+		want   string
+	}{
+		"no params":   {method: "abci_info", want: "abci_info.json"},
+		"height":      {method: "commit", params: []string{"1234"}, want: "commit-1234.json"},
+		"query param": {method: "subscribe", params: []string{"tm.event='NewBlock'"}, want: "subscribe-tm.event__NewBlock_.json"},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			if got := fixtureName(tc.method, tc.params); got != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
@@ -1,34 +1,36 @@
 package metrics
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
-)
-
-func EnsureSchema(pg *sql.DB) error {
-	tx, err := pg.Begin()
-	if err != nil {
-		return fmt.Errorf("transaction begin: %s", err)
-	}
-	defer tx.Rollback()
+	"time"
 
-	for _, query := range strings.Split(schema, "\n---\n") {
-		query = strings.TrimSpace(query)
-
-		if _, err := tx.Exec(query); err != nil {
-			return &QueryError{Query: query, Err: err}
-		}
-	}
+	"github.com/iov-one/block-metrics/pkg/errors"
+)
 
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("transaction commit: %s", err)
-	}
-	return nil
+// Migration is a single, numbered change of the database schema. Migrations
+// are applied in the order of their versions and each is applied only once.
+type Migration struct {
+	Version int
+	Name    string
+	// Up applies the change.
+	Up string
+	// Down reverts the change. It is empty if there is nothing to revert.
+	Down string
 }
 
-const schema = `
-
+// migrations is the full history of the database schema. Never change a
+// migration that was released, always append a new one instead.
+//
+// Schemas created before migrations were introduced are picked up by the
+// migrations, which is why they do not fail on existing tables and columns.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: `
 CREATE TABLE IF NOT EXISTS validators (
 	id SERIAL PRIMARY KEY,
 	public_key BYTEA NOT NULL UNIQUE,
@@ -36,8 +38,6 @@ CREATE TABLE IF NOT EXISTS validators (
 	memo TEXT
 );
 
----
-
 CREATE TABLE IF NOT EXISTS blocks (
 	block_height BIGINT NOT NULL PRIMARY KEY,
 	block_hash BYTEA NOT NULL,
@@ -47,8 +47,6 @@ CREATE TABLE IF NOT EXISTS blocks (
 	fee_frac BIGINT NOT NULL
 );
 
----
-
 CREATE TABLE IF NOT EXISTS block_participations (
 	id BIGSERIAL PRIMARY KEY,
 	validated BOOLEAN NOT NULL,
@@ -57,18 +55,323 @@ CREATE TABLE IF NOT EXISTS block_participations (
 	UNIQUE (block_id, validator_id)
 );
 
----
-
 CREATE TABLE IF NOT EXISTS transactions (
 	id BIGSERIAL PRIMARY KEY,
 	transaction_hash BYTEA NOT NULL,
 	block_id BIGINT NOT NULL REFERENCES blocks(block_height),
-	message TEXT 
+	message TEXT
 );
 
-CREATE INDEX ON transactions (transaction_hash);
----
-`
+CREATE INDEX IF NOT EXISTS transactions_transaction_hash_idx ON transactions (transaction_hash);
+`,
+		Down: `
+DROP TABLE transactions;
+DROP TABLE block_participations;
+DROP TABLE blocks;
+DROP TABLE validators;
+`,
+	},
+	{
+		Version: 2,
+		Name:    "remove duplicated transaction hash indexes",
+		// The transaction hash index used to be created without a
+		// name, each time the schema was ensured. Postgres named the
+		// copies transactions_transaction_hash_idx1, idx2 and so on.
+		Up: `
+DO $$
+DECLARE
+	idx RECORD;
+BEGIN
+	FOR idx IN
+		SELECT indexname FROM pg_indexes
+		WHERE schemaname = current_schema()
+			AND tablename = 'transactions'
+			AND indexname ~ '^transactions_transaction_hash_idx[0-9]+$'
+	LOOP
+		EXECUTE 'DROP INDEX ' || quote_ident(idx.indexname);
+	END LOOP;
+END $$;
+`,
+	},
+	{
+		Version: 3,
+		Name:    "fees per currency",
+		Up: `
+ALTER TABLE transactions
+	ADD COLUMN IF NOT EXISTS fee_ticker TEXT,
+	ADD COLUMN IF NOT EXISTS fee_whole BIGINT,
+	ADD COLUMN IF NOT EXISTS fee_fractional BIGINT;
+
+CREATE TABLE IF NOT EXISTS block_fees (
+	block_id BIGINT NOT NULL REFERENCES blocks(block_height),
+	ticker TEXT NOT NULL,
+	whole BIGINT NOT NULL,
+	fractional BIGINT NOT NULL,
+	PRIMARY KEY (block_id, ticker)
+);
+`,
+		Down: `
+DROP TABLE block_fees;
+ALTER TABLE transactions
+	DROP COLUMN fee_ticker,
+	DROP COLUMN fee_whole,
+	DROP COLUMN fee_fractional;
+`,
+	},
+	{
+		Version: 4,
+		Name:    "messages",
+		Up: `
+CREATE TABLE IF NOT EXISTS messages (
+	id BIGSERIAL PRIMARY KEY,
+	transaction_id BIGINT NOT NULL REFERENCES transactions(id),
+	message_index INT NOT NULL,
+	path TEXT NOT NULL,
+	details JSONB NOT NULL,
+	UNIQUE (transaction_id, message_index)
+);
+
+CREATE INDEX IF NOT EXISTS messages_path_idx ON messages (path);
+`,
+		Down: `
+DROP TABLE messages;
+`,
+	},
+	{
+		Version: 5,
+		Name:    "sync state",
+		Up: `
+CREATE TABLE IF NOT EXISTS sync_state (
+	id INT PRIMARY KEY CHECK (id = 1),
+	node_uri TEXT NOT NULL,
+	synced_height BIGINT NOT NULL,
+	chain_height BIGINT NOT NULL,
+	last_error TEXT NOT NULL,
+	started_at TIMESTAMPTZ NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL,
+	stopped_at TIMESTAMPTZ
+);
+`,
+		Down: `
+DROP TABLE sync_state;
+`,
+	},
+	{
+		Version: 6,
+		Name:    "validator sets",
+		Up: `
+CREATE TABLE IF NOT EXISTS validator_sets (
+	validators_hash BYTEA NOT NULL,
+	validator_id INT NOT NULL REFERENCES validators(id),
+	voting_power BIGINT NOT NULL,
+	proposer_priority BIGINT NOT NULL,
+	first_height BIGINT NOT NULL,
+	PRIMARY KEY (validators_hash, validator_id)
+);
+
+ALTER TABLE blocks ADD COLUMN IF NOT EXISTS validators_hash BYTEA;
+`,
+		Down: `
+ALTER TABLE blocks DROP COLUMN validators_hash;
+DROP TABLE validator_sets;
+`,
+	},
+	{
+		Version: 7,
+		Name:    "nil votes",
+		Up: `
+ALTER TABLE block_participations
+	ADD COLUMN IF NOT EXISTS nil_vote BOOLEAN NOT NULL DEFAULT false;
+`,
+		Down: `
+ALTER TABLE block_participations DROP COLUMN nil_vote;
+`,
+	},
+}
+
+// LatestSchemaVersion returns the version of the most recent migration.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// migrationLockID is the key of the postgres advisory lock that is held while
+// migrating, so that several collectors can be started at once.
+const migrationLockID = 0x626c6f636b73
+
+// MigrationStatus describes a single migration and whether it was applied to
+// the database.
+type MigrationStatus struct {
+	Version int
+	Name    string
+	// AppliedAt is nil if the migration was not applied.
+	AppliedAt *time.Time
+}
+
+// SchemaStatus returns the status of all known migrations, in order.
+func SchemaStatus(ctx context.Context, db *sql.DB) ([]MigrationStatus, error) {
+	var res []MigrationStatus
+	err := withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			s := MigrationStatus{Version: m.Version, Name: m.Name}
+			if at, ok := applied[m.Version]; ok {
+				s.AppliedAt = &at
+			}
+			res = append(res, s)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// MigrateUp applies all migrations up to and including given version, that
+// were not applied yet. Use LatestSchemaVersion to bring the schema up to
+// date. The number of applied migrations is returned.
+func MigrateUp(ctx context.Context, db *sql.DB, version int) (int, error) {
+	if version > LatestSchemaVersion() {
+		return 0, errors.Wrapf(ErrNotFound, "no migration %d", version)
+	}
+	var n int
+	err := withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for v := range applied {
+			if v > LatestSchemaVersion() {
+				return errors.Wrapf(ErrConflict, "database schema version %d is newer than supported %d", v, LatestSchemaVersion())
+			}
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok || m.Version > version {
+				continue
+			}
+			err := migrate(ctx, conn, m.Up, `
+				INSERT INTO schema_migrations (version, name, applied_at)
+				VALUES ($1, $2, $3)
+			`, m.Version, m.Name, time.Now().UTC())
+			if err != nil {
+				return errors.Wrapf(err, "migration %d up", m.Version)
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// MigrateDown reverts all applied migrations with a version greater than
+// given one, the most recent first. The number of reverted migrations is
+// returned.
+func MigrateDown(ctx context.Context, db *sql.DB, version int) (int, error) {
+	if version < 0 {
+		return 0, errors.Wrapf(ErrNotFound, "no migration %d", version)
+	}
+	var n int
+	err := withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok || m.Version <= version {
+				continue
+			}
+			err := migrate(ctx, conn, m.Down, `
+				DELETE FROM schema_migrations WHERE version = $1
+			`, m.Version)
+			if err != nil {
+				return errors.Wrapf(err, "migration %d down", m.Version)
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// migrate executes the migration query and the bookkeeping query within a
+// single transaction.
+func migrate(ctx context.Context, conn *sql.Conn, query string, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapPgErr(err, "transaction begin")
+	}
+	defer tx.Rollback()
+
+	if query = strings.TrimSpace(query); query != "" {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return &QueryError{Query: query, Err: err}
+		}
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return wrapPgErr(err, "record migration")
+	}
+	return wrapPgErr(tx.Commit(), "transaction commit")
+}
+
+// withMigrationLock calls fn while holding the migration lock. Advisory locks
+// belong to the session, so all queries must use the connection given to fn.
+// The migrations table is created if missing.
+func withMigrationLock(ctx context.Context, db *sql.DB, fn func(*sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return wrapPgErr(err, "connection")
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return wrapPgErr(err, "acquire migration lock")
+	}
+	// Unlock even if the context was cancelled. Closing the
+	// connection would release the lock as well, but the connection
+	// is returned to the pool instead.
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL
+		)
+	`)
+	if err != nil {
+		return wrapPgErr(err, "create migrations table")
+	}
+	return fn(conn)
+}
+
+// appliedMigrations returns the time of application of each applied
+// migration version.
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `
+		SELECT version, applied_at FROM schema_migrations
+	`)
+	if err != nil {
+		return nil, wrapPgErr(err, "query migrations")
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version int
+			at      time.Time
+		)
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, wrapPgErr(err, "scan migration")
+		}
+		applied[version] = at.UTC()
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapPgErr(err, "scanning migrations")
+	}
+	return applied, nil
+}
 
 type QueryError struct {
 	Query string
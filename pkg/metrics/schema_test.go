@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestMigrationVersions(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Fatalf("migration %q: want version %d, got %d", m.Name, i+1, m.Version)
+		}
+		if m.Up == "" {
+			t.Fatalf("migration %d: no up step", m.Version)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db, cleanup := ensureDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	status, err := SchemaStatus(ctx, db)
+	if err != nil {
+		t.Fatalf("cannot get status: %s", err)
+	}
+	if len(status) != LatestSchemaVersion() {
+		t.Fatalf("want %d migrations, got %d", LatestSchemaVersion(), len(status))
+	}
+	for _, s := range status {
+		if s.AppliedAt == nil {
+			t.Fatalf("migration %d not applied", s.Version)
+		}
+	}
+
+	if n, err := MigrateUp(ctx, db, LatestSchemaVersion()); err != nil || n != 0 {
+		t.Fatalf("want nothing to apply, got %d: %v", n, err)
+	}
+
+	// Each migration can be reverted on its own.
+	for v := LatestSchemaVersion() - 1; v > 0; v-- {
+		if n, err := MigrateDown(ctx, db, v); err != nil || n != 1 {
+			t.Fatalf("want migration %d reverted, got %d: %v", v+1, n, err)
+		}
+	}
+	if n, err := MigrateUp(ctx, db, LatestSchemaVersion()); err != nil || n != LatestSchemaVersion()-1 {
+		t.Fatalf("want all but the first migration applied, got %d: %v", n, err)
+	}
+
+	if n, err := MigrateDown(ctx, db, 1); err != nil || n != LatestSchemaVersion()-1 {
+		t.Fatalf("want all but the first migration reverted, got %d: %v", n, err)
+	}
+	status, err = SchemaStatus(ctx, db)
+	if err != nil {
+		t.Fatalf("cannot get status: %s", err)
+	}
+	if status[0].AppliedAt == nil || status[1].AppliedAt != nil {
+		t.Fatalf("unexpected status after down: %#v", status)
+	}
+	if n, err := MigrateDown(ctx, db, 0); err != nil || n != 1 {
+		t.Fatalf("want the first migration reverted, got %d: %v", n, err)
+	}
+	if _, err := db.Exec(`SELECT 1 FROM validators`); err == nil {
+		t.Fatal("validators table not dropped")
+	}
+
+	// Concurrent migrations must not apply the same step twice.
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		applied int
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := MigrateUp(ctx, db, LatestSchemaVersion())
+			if err != nil {
+				t.Errorf("cannot migrate: %s", err)
+			}
+			mu.Lock()
+			applied += n
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if applied != LatestSchemaVersion() {
+		t.Fatalf("want %d migrations applied, got %d", LatestSchemaVersion(), applied)
+	}
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"context"
+)
+
+// BlockStore is the storage of the synchronized blocks and validators.
+//
+// Store is the Postgres backed implementation used in production. MemStore
+// keeps everything in memory and is meant for tests and running without a
+// database.
+type BlockStore interface {
+	// InsertValidator adds a validator and returns its newly created ID.
+	// It returns ErrConflict if a validator with the same public key or
+	// address exists.
+	InsertValidator(ctx context.Context, publicKey, address []byte) (int64, error)
+	// ValidatorAddressID returns an ID of a validator with given
+	// address. It returns ErrNotFound if no such validator exists.
+	ValidatorAddressID(ctx context.Context, address []byte) (int64, error)
+	// ValidatorAddresses returns the addresses of validators with given
+	// IDs. Validators that do not exist are not included.
+	ValidatorAddresses(ctx context.Context, ids []int64) (map[int64][]byte, error)
+
+	// InsertBlock adds a block together with its participations, fees
+	// and transactions. It returns ErrConflict if the block has no
+	// participants, the height is already taken or a referenced
+	// validator does not exist.
+	InsertBlock(ctx context.Context, b Block) error
+	// InsertBlocks adds all given blocks. It returns ErrConflict if any
+	// of the blocks cannot be inserted, in which case none is.
+	InsertBlocks(ctx context.Context, blocks []Block) error
+	// LatestBlock returns the block with the greatest height. It returns
+	// ErrNotFound if there are no blocks.
+	LatestBlock(ctx context.Context) (*Block, error)
+	// LoadBlock returns the block with given height. It returns
+	// ErrNotFound if no such block exists.
+	LoadBlock(ctx context.Context, blockHeight int64) (*Block, error)
+	// DeleteBlocksAbove removes all blocks with the height greater than
+	// given one and returns their number.
+	DeleteBlocksAbove(ctx context.Context, blockHeight int64) (int64, error)
+
+	// InsertValidatorSet adds the validator set identified by given
+	// hash. Set that is already present is not modified.
+	InsertValidatorSet(ctx context.Context, hash []byte, firstHeight int64, members []ValidatorSetMember) error
+	// LoadValidatorSet returns all members of the validator set
+	// identified by given hash, ordered by the voting power, highest
+	// first. It returns ErrNotFound if no such set exists.
+	LoadValidatorSet(ctx context.Context, hash []byte) ([]ValidatorSetMember, error)
+
+	// Query methods return the cursor of the next page together with
+	// the results. It is empty if there are no more results. ErrInvalid
+	// is returned if the page cursor is malformed.
+
+	// Blocks returns blocks matching given filter, the highest first.
+	Blocks(ctx context.Context, f BlockFilter, p Page) ([]*Block, string, error)
+	// Transactions returns transactions matching given filter, the most
+	// recent first.
+	Transactions(ctx context.Context, f TransactionFilter, p Page) ([]*BlockTransaction, string, error)
+	// Validators returns validators matching given filter, ordered by
+	// ID, with their participation counted over the filter height range.
+	Validators(ctx context.Context, f ValidatorFilter, p Page) ([]*ValidatorStats, string, error)
+	// Participations returns the participation of a validator in the
+	// blocks matching given filter, the highest first.
+	Participations(ctx context.Context, f ParticipationFilter, p Page) ([]*Participation, string, error)
+
+	// UpdateSyncState replaces the stored synchronization progress.
+	UpdateSyncState(ctx context.Context, state SyncState) error
+	// LoadSyncState returns the synchronization progress. It returns
+	// ErrNotFound if no state was written yet.
+	LoadSyncState(ctx context.Context) (*SyncState, error)
+}
+
+var (
+	_ BlockStore = (*Store)(nil)
+	_ BlockStore = (*MemStore)(nil)
+)
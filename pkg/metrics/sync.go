@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"log"
 	"time"
 
 	"github.com/iov-one/block-metrics/pkg/errors"
@@ -12,197 +13,878 @@ import (
 	"github.com/iov-one/weave/x/batch"
 )
 
-const syncRetryTimeout = 3 * time.Second
+const (
+	syncRetryTimeout = 3 * time.Second
+
+	// canonicalCheckInterval is how often the synced blocks are verified
+	// to be part of the chain served by tendermint.
+	canonicalCheckInterval = time.Minute
+)
+
+// SyncConfig configures the synchronization process. Zero value fields are
+// replaced with defaults.
+type SyncConfig struct {
+	// Workers is the number of heights that are fetched from tendermint
+	// concurrently.
+	Workers int
+	// Prefetch is the maximum number of heights that are fetched ahead of
+	// the height that is being inserted.
+	Prefetch int
+	// NodeURI is the address of the tendermint node, as reported in the
+	// sync state.
+	NodeURI string
+	// Retry configures how failed tendermint requests are repeated.
+	Retry RetryPolicy
+	// BatchSize is the number of blocks inserted within a single database
+	// transaction when the synchronization is far behind the chain head.
+	BatchSize int
+	// FetchBatch is the number of heights that commits and blocks are
+	// fetched for using a single batch request. It is used only if the
+	// tendermint client supports batch requests.
+	FetchBatch int
+}
+
+func (c SyncConfig) withDefaults() SyncConfig {
+	if c.Workers <= 0 {
+		c.Workers = 4
+	}
+	if c.Prefetch <= 0 {
+		c.Prefetch = 32
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 100
+	}
+	if c.FetchBatch <= 0 {
+		c.FetchBatch = 10
+	}
+	c.Retry = c.Retry.withDefaults()
+	return c
+}
+
+// RetryPolicy configures how tendermint requests that failed with a
+// transient error are repeated. Zero value fields are replaced with defaults.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a request is made.
+	MaxAttempts int
+	// InitialBackoff is the time to wait before the first retry. Each
+	// following retry waits twice as long as the previous one.
+	InitialBackoff time.Duration
+	// MaxBackoff limits the time to wait before a retry.
+	MaxBackoff time.Duration
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 5
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = 500 * time.Millisecond
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 30 * time.Second
+	}
+	return p
+}
+
+// do calls fn until it succeeds, fails with an error that is not transient or
+// the maximum number of attempts is reached.
+func (p RetryPolicy) do(ctx context.Context, fn func() error) error {
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !IsTransient(err) {
+			return errors.Wrap(err, "permanent failure")
+		}
+		if attempt >= p.MaxAttempts {
+			return errors.Wrapf(err, "giving up after %d attempts", attempt)
+		}
+
+		log.Printf("transient failure, retrying in %s: %s", backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
 
 // Sync uploads to local store all blocks that are not present yet, starting
 // with the blocks with the lowest hight first. It always returns the number of
 // blocks inserted, even if returning an error.
-func Sync(ctx context.Context, tmc *TendermintClient, st *Store) (uint, error) {
-	var (
-		inserted        uint
-		syncedHeight    int64
-		lastKnownHeight int64
-	)
+func Sync(ctx context.Context, tmc TendermintRPC, st BlockStore, conf SyncConfig) (uint, error) {
+	sn := newSyncer(tmc, st, conf)
+	inserted, err := sn.poll(ctx)
+	err = castInterrupted(ctx, err)
+	sn.recordStop(err)
+	return inserted, err
+}
+
+// StreamSync works similar to Sync, but instead of polling for new blocks it
+// subscribes to the new block events using the websocket connection. It
+// first uploads all blocks that are not present yet and then inserts each
+// new block as it arrives. It never quits unless context was cancelled or an
+// error occurred. It always returns the number of blocks inserted, even if
+// returning an error.
+func StreamSync(ctx context.Context, tmc *TendermintClient, st BlockStore, conf SyncConfig) (uint, error) {
+	sn := newSyncer(tmc, st, conf)
+	inserted, err := sn.stream(ctx, tmc)
+	err = castInterrupted(ctx, err)
+	sn.recordStop(err)
+	return inserted, err
+}
+
+// ErrInterrupted is returned when the synchronization was stopped because
+// the context was cancelled.
+var ErrInterrupted = errors.New("interrupted")
+
+// castInterrupted returns ErrInterrupted if the synchronization failed
+// because the context was cancelled. Cancellation can cause any operation to
+// fail, so the original error is preserved in the description.
+func castInterrupted(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || ErrInterrupted.Is(err) {
+		return err
+	}
+	return errors.Wrap(ErrInterrupted, err.Error())
+}
+
+// poll implements Sync.
+func (sn *syncer) poll(ctx context.Context) (uint, error) {
+	var inserted uint
+
+	syncedHeight, err := sn.start(ctx)
+	if err != nil {
+		return inserted, err
+	}
+
+	for {
+		n, height, err := sn.catchUp(ctx, syncedHeight)
+		inserted += n
+		if err != nil {
+			return inserted, err
+		}
+		syncedHeight = height
+
+		select {
+		case <-ctx.Done():
+			return inserted, ctx.Err()
+		case <-time.After(syncRetryTimeout):
+		}
+	}
+}
+
+// stream implements StreamSync.
+func (sn *syncer) stream(ctx context.Context, tmc *TendermintClient) (uint, error) {
+	var inserted uint
+
+	syncedHeight, err := sn.start(ctx)
+	if err != nil {
+		return inserted, err
+	}
+
+	// Subscribe before catching up so that no block is created unnoticed
+	// in between.
+	// Headers are enough to learn about the new height and are much
+	// smaller than blocks.
+	events, err := tmc.Subscribe(ctx, "tm.event='NewBlockHeader'")
+	if err != nil {
+		return inserted, errors.Wrap(err, "subscribe to new blocks")
+	}
+
+	n, syncedHeight, err := sn.catchUp(ctx, syncedHeight)
+	inserted += n
+	if err != nil {
+		return inserted, err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return inserted, ctx.Err()
+		case ev, ok := <-events:
+			if !ok {
+				return inserted, errors.New("new block subscription closed")
+			}
+			if ev.Err != nil {
+				return inserted, errors.Wrap(ev.Err, "new block event")
+			}
+			if ev.NewBlockHeader == nil {
+				return inserted, errors.Wrapf(ErrFailedResponse, "unexpected %q event", ev.Type)
+			}
+			// Events can be dropped, so always insert all blocks
+			// up to the one announced.
+			n, syncedHeight, err = sn.syncTo(ctx, syncedHeight, ev.NewBlockHeader.Height)
+			inserted += n
+			if err != nil {
+				return inserted, err
+			}
+		}
+	}
+}
 
+// latestHeight returns the height of the latest block present in the store
+// or zero if the store is empty.
+func latestHeight(ctx context.Context, st BlockStore) (int64, error) {
 	switch block, err := st.LatestBlock(ctx); {
 	case ErrNotFound.Is(err):
-		syncedHeight = 0
+		return 0, nil
 	case err == nil:
-		syncedHeight = block.Height
+		return block.Height, nil
 	default:
-		return inserted, errors.Wrap(err, "latest block")
+		return 0, errors.Wrap(err, "latest block")
 	}
+}
+
+// syncer holds the state that must be preserved between inserting
+// consecutive blocks.
+type syncer struct {
+	tmc  TendermintRPC
+	st   BlockStore
+	conf SyncConfig
 
 	// Keep the mapping for validator address to their numeric ID in memory
 	// to avoid querying the database for every insert.
-	validatorIDs := newValidatorsCache(tmc, st)
-	var vSet []*TendermintValidator
-	var vHash []byte
+	validatorIDs *validatorsCache
+	vSet         []*TendermintValidator
+	vHash        []byte
 
-	for {
-		nextHeight := syncedHeight + 1
-		if lastKnownHeight < nextHeight {
-			info, err := AbciInfo(tmc)
-			if err != nil {
-				return inserted, errors.Wrap(err, "info")
-			}
+	lastCanonicalCheck time.Time
 
-			lastKnownHeight = info.LastBlockHeight
-		}
+	// state is the progress of the synchronization as last written to the
+	// store.
+	state SyncState
+}
 
-		if lastKnownHeight < nextHeight {
-			select {
-			case <-ctx.Done():
-				return inserted, ctx.Err()
-			case <-time.After(syncRetryTimeout):
-			}
-			// make sure we don't run into the bug where we try to retrieve a commit for non-existent height
-			continue
-		}
+func newSyncer(tmc TendermintRPC, st BlockStore, conf SyncConfig) *syncer {
+	return &syncer{
+		tmc:          tmc,
+		st:           st,
+		conf:         conf.withDefaults(),
+		validatorIDs: newValidatorsCache(tmc, st, conf.Retry.withDefaults()),
+	}
+}
 
-		c, err := Commit(ctx, tmc, nextHeight)
-		if err != nil {
-			// BUG this can happen when the commit does not exist.
-			// There is no sane way to distinguish this case from
-			// any other tendermint API error.
-			return inserted, errors.Wrapf(err, "blocks for %d", syncedHeight+1)
-		}
-		syncedHeight = c.Height
+// start records the beginning of the synchronization and returns the height
+// of the latest block present in the store.
+func (sn *syncer) start(ctx context.Context) (int64, error) {
+	syncedHeight, err := latestHeight(ctx, sn.st)
+	if err != nil {
+		return 0, err
+	}
 
-		propID, err := validatorIDs.DatabaseID(ctx, c.ProposerAddress, c.Height)
-		if err != nil {
-			return inserted, errors.Wrap(err, "validator ID")
-		}
+	now := syncStateTime()
+	sn.state = SyncState{
+		NodeURI:      sn.conf.NodeURI,
+		SyncedHeight: syncedHeight,
+		StartedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := sn.st.UpdateSyncState(ctx, sn.state); err != nil {
+		return 0, errors.Wrap(err, "sync state")
+	}
+	return syncedHeight, nil
+}
+
+// recordProgress writes the current progress of the synchronization to the
+// store.
+func (sn *syncer) recordProgress(ctx context.Context, syncedHeight, chainHeight int64) error {
+	sn.state.SyncedHeight = syncedHeight
+	sn.state.ChainHeight = chainHeight
+	sn.state.UpdatedAt = syncStateTime()
+	if err := sn.st.UpdateSyncState(ctx, sn.state); err != nil {
+		return errors.Wrap(err, "sync state")
+	}
+	return nil
+}
+
+// recordStop writes the reason why the synchronization stopped to the store.
+// The context of the synchronization is most likely cancelled at this point,
+// so a new one is used.
+func (sn *syncer) recordStop(reason error) {
+	if sn.state.StartedAt.IsZero() {
+		// Synchronization did not start.
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-		participantIDs, err := validatorIDs.DatabaseIDs(ctx, c.ParticipantAddresses, c.Height)
+	now := syncStateTime()
+	sn.state.UpdatedAt = now
+	sn.state.StoppedAt = &now
+	if reason != nil {
+		sn.state.LastError = reason.Error()
+	}
+	if err := sn.st.UpdateSyncState(ctx, sn.state); err != nil {
+		log.Printf("cannot record sync stop: %s", err)
+	}
+}
+
+// syncStateTime returns the current time with the precision supported by
+// the store.
+func syncStateTime() time.Time {
+	// Postgres TIMESTAMPTZ precision is microseconds.
+	return time.Now().UTC().Round(time.Microsecond)
+}
+
+// catchUp inserts all blocks following syncedHeight, up to the last block
+// height known to tendermint. It returns the number of blocks inserted and
+// the height of the last block inserted, even if returning an error.
+func (sn *syncer) catchUp(ctx context.Context, syncedHeight int64) (uint, int64, error) {
+	var info *ABCIInfo
+	err := sn.conf.Retry.do(ctx, func() (err error) {
+		info, err = AbciInfo(ctx, sn.tmc)
+		return err
+	})
+	if err != nil {
+		return 0, syncedHeight, errors.Wrap(err, "info")
+	}
+	// make sure we don't run into the bug where we try to retrieve a commit for non-existent height
+	return sn.syncTo(ctx, syncedHeight, info.LastBlockHeight)
+}
+
+// syncTo inserts all blocks following syncedHeight, up to the chainHeight.
+// It returns the number of blocks inserted and the height of the last block
+// inserted, even if returning an error.
+func (sn *syncer) syncTo(ctx context.Context, syncedHeight, chainHeight int64) (uint, int64, error) {
+	var inserted uint
+
+	// The stored chain must be verified even if there is nothing to
+	// insert, because tendermint might serve a different chain that is
+	// not longer than the stored one.
+	syncedHeight, err := sn.periodicCanonicalCheck(ctx, syncedHeight, chainHeight)
+	if err != nil {
+		return inserted, syncedHeight, err
+	}
+
+	for syncedHeight < chainHeight {
+		n, height, err := sn.syncRange(ctx, syncedHeight, chainHeight)
+		inserted += n
+		syncedHeight = height
 		if err != nil {
-			return inserted, errors.Wrap(err, "validator ID")
+			return inserted, syncedHeight, err
 		}
+	}
+	return inserted, syncedHeight, nil
+}
 
-		// only query when validator hash changes
-		if !bytes.Equal(c.ValidatorsHash, vHash) {
-			var err error
-			vSet, err = Validators(ctx, tmc, c.Height)
+// syncRange inserts blocks following syncedHeight, up to the chainHeight.
+// Blocks are fetched concurrently but always inserted in height order. When
+// far behind the chainHeight, blocks are inserted in batches. This function
+// returns early if the stored chain diverged and was rewound. It returns the
+// number of blocks inserted and the height of the last block inserted, even
+// if returning an error.
+func (sn *syncer) syncRange(ctx context.Context, syncedHeight, chainHeight int64) (uint, int64, error) {
+	var inserted uint
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := sn.prefetch(ctx, syncedHeight+1, chainHeight)
+	batch := make([]Block, 0, sn.conf.BatchSize)
+
+	for syncedHeight < chainHeight {
+		// Canonical check requires all processed blocks to be
+		// stored.
+		if len(batch) == 0 {
+			height, err := sn.periodicCanonicalCheck(ctx, syncedHeight, chainHeight)
 			if err != nil {
-				return inserted, errors.Wrap(err, "cannot get validator set")
+				return inserted, syncedHeight, err
+			}
+			if height != syncedHeight {
+				// Prefetched blocks are no longer relevant.
+				return inserted, height, nil
 			}
-			vHash = c.ValidatorsHash
 		}
 
-		missing := SubtractSets(ValidatorAddresses(vSet), c.ParticipantAddresses)
-		missingIDs, err := validatorIDs.DatabaseIDs(ctx, missing, c.Height)
+		var res *fetchResult
+		select {
+		case <-ctx.Done():
+			return inserted, syncedHeight, ctx.Err()
+		case r, ok := <-results:
+			if !ok {
+				// Results are closed early only when the context
+				// was cancelled.
+				return inserted, syncedHeight, ctx.Err()
+			}
+			res = r
+		}
+		if res.err != nil {
+			return inserted, syncedHeight, res.err
+		}
+		block, err := sn.build(ctx, res.commit, res.block)
 		if err != nil {
-			return inserted, errors.Wrap(err, "validator ID")
+			return inserted, syncedHeight, err
 		}
+		batch = append(batch, *block)
 
-		tmblock, err := FetchBlock(ctx, tmc, nextHeight)
-		if err != nil {
-			return inserted, errors.Wrapf(err, "blocks for %d", syncedHeight+1)
+		// When close to the chain head, insert each block right away
+		// so that it is available as soon as possible.
+		if len(batch) < sn.conf.BatchSize && chainHeight-block.Height >= int64(sn.conf.BatchSize) {
+			continue
+		}
+		if err := sn.store(ctx, batch); err != nil {
+			return inserted, syncedHeight, err
+		}
+		inserted += uint(len(batch))
+		syncedHeight = block.Height
+		batch = batch[:0]
+
+		if err := sn.recordProgress(ctx, syncedHeight, chainHeight); err != nil {
+			return inserted, syncedHeight, err
+		}
+	}
+	return inserted, syncedHeight, nil
+}
+
+// store inserts all given blocks into the store.
+func (sn *syncer) store(ctx context.Context, blocks []Block) error {
+	if len(blocks) == 1 {
+		if err := sn.st.InsertBlock(ctx, blocks[0]); err != nil {
+			return errors.Wrapf(err, "insert block %d", blocks[0].Height)
 		}
+		return nil
+	}
+	if err := sn.st.InsertBlocks(ctx, blocks); err != nil {
+		return errors.Wrapf(err, "insert blocks %d-%d", blocks[0].Height, blocks[len(blocks)-1].Height)
+	}
+	return nil
+}
+
+// fetchResult holds all information that is fetched from tendermint in order
+// to insert a single block.
+type fetchResult struct {
+	commit *TendermintCommit
+	block  *TendermintBlock
+	err    error
+}
+
+// prefetch concurrently fetches commits and blocks for all heights from the
+// given range. Results are delivered in height order. At most conf.Prefetch
+// heights are fetched ahead of the consumer, using conf.Workers concurrent
+// workers. If the client supports batch requests, each worker fetches
+// conf.FetchBatch heights at once. Cancel the context to release all
+// resources.
+func (sn *syncer) prefetch(ctx context.Context, from, to int64) <-chan *fetchResult {
+	pending := make(chan chan *fetchResult, sn.conf.Prefetch)
+	workers := make(chan struct{}, sn.conf.Workers)
+
+	chunkSize := int64(1)
+	batcher, canBatch := sn.tmc.(TendermintBatchRPC)
+	if canBatch {
+		chunkSize = int64(sn.conf.FetchBatch)
+	}
 
-		var feeFrac uint64
-		messages := make([]string, 0) // Avoid nil array
-		transactions := make([]Transaction, 0, len(tmblock.Transactions))
-		for k, tx := range tmblock.Transactions {
-			if info := tx.GetFees(); info != nil {
-				if info.Fees.Ticker != "IOV" {
-					panic("fees in currency other than IOV are not supported")
+	go func() {
+		defer close(pending)
+
+		for h := from; h <= to; h += chunkSize {
+			last := h + chunkSize - 1
+			if last > to {
+				last = to
+			}
+
+			chunk := make([]chan *fetchResult, 0, last-h+1)
+			for i := h; i <= last; i++ {
+				res := make(chan *fetchResult, 1)
+				select {
+				case pending <- res:
+				case <-ctx.Done():
+					return
 				}
-				feeFrac += uint64(info.Fees.GetWhole()*coin.FracUnit + info.Fees.GetFractional())
+				chunk = append(chunk, res)
 			}
+			select {
+			case workers <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(from, to int64) {
+				defer func() { <-workers }()
+				if !canBatch {
+					chunk[0] <- sn.fetch(ctx, from)
+					return
+				}
+				for i, r := range sn.fetchRange(ctx, batcher, from, to) {
+					chunk[i] <- r
+				}
+			}(h, last)
+		}
+	}()
 
-			// The batch message is not split to expose each
-			// message separaterly. This would be a nice feature.
-			// Similar with getting details of the proposal.
-			msg, err := tx.GetMsg()
-			if err != nil {
-				return inserted, errors.Wrap(err, "cannot get transaction message")
+	results := make(chan *fetchResult)
+	go func() {
+		defer close(results)
+
+		for res := range pending {
+			var r *fetchResult
+			select {
+			case r = <-res:
+			case <-ctx.Done():
+				return
 			}
-			messages = append(messages, msg.Path())
-			msgDetails, err := messageDetails(msg)
-			if err != nil {
-				return inserted, errors.Wrap(err, "cannot get transaction message detail")
+			select {
+			case results <- r:
+			case <-ctx.Done():
+				return
 			}
+		}
+	}()
+	return results
+}
+
+// fetch returns the commit and the block at given height. This method is safe
+// for concurrent use.
+func (sn *syncer) fetch(ctx context.Context, height int64) *fetchResult {
+	var c *TendermintCommit
+	err := sn.conf.Retry.do(ctx, func() (err error) {
+		c, err = Commit(ctx, sn.tmc, height)
+		return err
+	})
+	if err != nil {
+		return &fetchResult{err: errors.Wrapf(err, "blocks for %d", height)}
+	}
+
+	var tmblock *TendermintBlock
+	err = sn.conf.Retry.do(ctx, func() (err error) {
+		tmblock, err = FetchBlock(ctx, sn.tmc, height)
+		return err
+	})
+	if err != nil {
+		return &fetchResult{err: errors.Wrapf(err, "blocks for %d", height)}
+	}
+	return &fetchResult{commit: c, block: tmblock}
+}
 
-			transactions = append(transactions, Transaction{
-				Hash:    tmblock.TransactionHashes[k][:],
-				Message: msgDetails,
-			})
+// fetchRange returns the commits and the blocks for all heights from the given
+// range, in height order, using a single batch request. Heights that failed
+// within the batch are fetched again one by one. This method is safe for
+// concurrent use.
+func (sn *syncer) fetchRange(ctx context.Context, tmc TendermintBatchRPC, from, to int64) []*fetchResult {
+	var (
+		commits = make([]commitPayload, to-from+1)
+		blocks  = make([]blockPayload, to-from+1)
+		calls   = make([]*BatchCall, 0, 2*len(commits))
+	)
+	for i := range commits {
+		height := from + int64(i)
+		calls = append(calls,
+			&BatchCall{Method: "commit", Args: []interface{}{height}, Dest: &commits[i]},
+			&BatchCall{Method: "block", Args: []interface{}{height}, Dest: &blocks[i]},
+		)
+	}
+
+	err := sn.conf.Retry.do(ctx, func() error {
+		return tmc.DoBatch(ctx, calls)
+	})
+
+	results := make([]*fetchResult, len(commits))
+	for i := range results {
+		height := from + int64(i)
+		if err != nil {
+			results[i] = &fetchResult{err: errors.Wrapf(err, "blocks for %d", height)}
+			continue
+		}
+		if calls[2*i].Err != nil || calls[2*i+1].Err != nil {
+			results[i] = sn.fetch(ctx, height)
+			continue
+		}
+		tmblock, err := blocks[i].block()
+		if err != nil {
+			results[i] = &fetchResult{err: errors.Wrapf(err, "blocks for %d", height)}
+			continue
 		}
+		results[i] = &fetchResult{commit: commits[i].commit(), block: tmblock}
+	}
+	return results
+}
+
+// periodicCanonicalCheck calls ensureCanonical if the last check was done
+// more than canonicalCheckInterval ago. The first call always runs the check.
+func (sn *syncer) periodicCanonicalCheck(ctx context.Context, syncedHeight, chainHeight int64) (int64, error) {
+	if time.Since(sn.lastCanonicalCheck) < canonicalCheckInterval {
+		return syncedHeight, nil
+	}
+	return sn.ensureCanonical(ctx, syncedHeight, chainHeight)
+}
+
+// ensureCanonical compares the hash of the latest synced block with the one
+// provided by tendermint. If they differ, the stored chain diverged from the
+// one served by tendermint. In such case the highest height on which both
+// chains agree is found and all stored blocks above it are deleted. It returns
+// the height that the synchronization should continue from.
+//
+// Only blocks that tendermint knows about can be compared. If the store is
+// ahead of tendermint, the block at chainHeight is compared instead.
+func (sn *syncer) ensureCanonical(ctx context.Context, syncedHeight, chainHeight int64) (int64, error) {
+	sn.lastCanonicalCheck = time.Now()
+
+	height := syncedHeight
+	if height > chainHeight {
+		height = chainHeight
+	}
+	if height < 1 {
+		return syncedHeight, nil
+	}
+
+	switch ok, err := sn.isCanonical(ctx, height); {
+	case err != nil:
+		return syncedHeight, err
+	case ok:
+		return syncedHeight, nil
+	}
 
-		block := Block{
-			Height:         c.Height,
-			Hash:           c.Hash,
-			Time:           c.Time.UTC(),
-			ProposerID:     propID,
-			ParticipantIDs: participantIDs,
-			MissingIDs:     missingIDs,
-			Messages:       messages,
-			FeeFrac:        feeFrac,
-			Transactions: transactions,
+	// Block hash includes the hash of the previous block, so if the two
+	// chains agree at a given height, they agree on all heights below
+	// as well. Step back with an exponentially growing step to find a
+	// height where both chains agree and then use binary search to find
+	// the highest one.
+	good, bad := int64(0), height
+	for step := int64(1); bad-step > 0; step *= 2 {
+		ok, err := sn.isCanonical(ctx, bad-step)
+		if err != nil {
+			return syncedHeight, err
+		}
+		if ok {
+			good = bad - step
+			break
+		}
+		bad -= step
+	}
+	for bad-good > 1 {
+		mid := good + (bad-good)/2
+		ok, err := sn.isCanonical(ctx, mid)
+		if err != nil {
+			return syncedHeight, err
 		}
-		if err := st.InsertBlock(ctx, block); err != nil {
-			return inserted, errors.Wrapf(err, "insert block %d", c.Height)
+		if ok {
+			good = mid
+		} else {
+			bad = mid
 		}
-		inserted++
 	}
+
+	deleted, err := sn.st.DeleteBlocksAbove(ctx, good)
+	if err != nil {
+		return syncedHeight, errors.Wrapf(err, "rewind to %d", good)
+	}
+	log.Printf("chain diverged at height %d, %d blocks deleted", good+1, deleted)
+
+	// Validator set of the canonical chain might be different.
+	sn.vSet = nil
+	sn.vHash = nil
+
+	return good, nil
 }
 
-type Message struct {
-	Path    string `json:"path"`
-	Details string `json:"details"`
+// isCanonical returns true if the block stored at given height has the same
+// hash as the one provided by tendermint.
+func (sn *syncer) isCanonical(ctx context.Context, height int64) (bool, error) {
+	b, err := sn.st.LoadBlock(ctx, height)
+	if err != nil {
+		return false, errors.Wrapf(err, "load block %d", height)
+	}
+	var c *TendermintCommit
+	err = sn.conf.Retry.do(ctx, func() (err error) {
+		c, err = Commit(ctx, sn.tmc, height)
+		return err
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "commit for %d", height)
+	}
+	return bytes.Equal(b.Hash, c.Hash), nil
 }
 
-func messageDetails(msg weave.Msg) (string, error) {
-	switch message := msg.(type) {
-	case batch.Msg:
-		list, err := message.MsgList()
+// build completes the information fetched from tendermint about a single
+// block and returns the block ready to be inserted into the store. Blocks
+// must be built in height order.
+func (sn *syncer) build(ctx context.Context, c *TendermintCommit, tmblock *TendermintBlock) (*Block, error) {
+	propID, err := sn.validatorIDs.DatabaseID(ctx, c.ProposerAddress, c.Height)
+	if err != nil {
+		return nil, errors.Wrap(err, "validator ID")
+	}
+
+	participantIDs, err := sn.validatorIDs.DatabaseIDs(ctx, c.ParticipantAddresses, c.Height)
+	if err != nil {
+		return nil, errors.Wrap(err, "validator ID")
+	}
+
+	// only query when validator hash changes
+	if !bytes.Equal(c.ValidatorsHash, sn.vHash) {
+		var vSet []*TendermintValidator
+		err := sn.conf.Retry.do(ctx, func() (err error) {
+			vSet, err = Validators(ctx, sn.tmc, c.Height)
+			return err
+		})
 		if err != nil {
-			return "", err
+			return nil, errors.Wrap(err, "cannot get validator set")
+		}
+		if err := sn.storeValidatorSet(ctx, c, vSet); err != nil {
+			return nil, err
 		}
+		sn.vSet = vSet
+		sn.vHash = c.ValidatorsHash
+	}
 
-		messages := make([]Message, len(list))
+	nilVoteIDs, err := sn.validatorIDs.DatabaseIDs(ctx, c.NilVoteAddresses, c.Height)
+	if err != nil {
+		return nil, errors.Wrap(err, "validator ID")
+	}
 
-		for k, v := range list {
-			details, err := json.Marshal(v)
-			if err != nil {
-				return "", err
+	// Validators that voted nil did participate, just not in favour of
+	// this block, so they are not missing.
+	missing := SubtractSets(ValidatorAddresses(sn.vSet), c.ParticipantAddresses)
+	missing = SubtractSets(missing, c.NilVoteAddresses)
+	missingIDs, err := sn.validatorIDs.DatabaseIDs(ctx, missing, c.Height)
+	if err != nil {
+		return nil, errors.Wrap(err, "validator ID")
+	}
+
+	var (
+		feeFrac uint64
+		fees    coin.Coins
+	)
+	messages := make([]string, 0) // Avoid nil array
+	transactions := make([]Transaction, 0, len(tmblock.Transactions))
+	for k, tx := range tmblock.Transactions {
+		var fee *coin.Coin
+		if info := tx.GetFees(); info != nil && info.Fees != nil && !info.Fees.IsZero() {
+			fee = info.Fees.Clone()
+			if fee.Ticker == "IOV" {
+				feeFrac += uint64(fee.Whole*coin.FracUnit + fee.Fractional)
 			}
-			messages[k] = Message{
-				Path:    v.Path(),
-				Details: string(details),
+			fees, err = fees.Add(*fee)
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot sum %s fees", fee.Ticker)
 			}
 		}
 
-		res, err := json.Marshal(messages)
-		return string(res), err
-	default:
-		details, err := json.Marshal(message)
+		// Details of the proposal are not exposed. This would be a
+		// nice feature.
+		msg, err := tx.GetMsg()
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot get transaction message")
+		}
+		messages = append(messages, msg.Path())
+		txMessages, err := splitMessages(msg)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot split transaction message")
+		}
+		msgDetails, err := messageDetails(msg, txMessages)
 		if err != nil {
-			return "", err
+			return nil, errors.Wrap(err, "cannot get transaction message detail")
 		}
 
-		res, err := json.Marshal(
-			Message{
-				Path:    message.Path(),
-				Details: string(details)})
-		return string(res), err
+		transactions = append(transactions, Transaction{
+			Hash:     tmblock.TransactionHashes[k][:],
+			Message:  msgDetails,
+			Fee:      fee,
+			Messages: txMessages,
+		})
+	}
+
+	block := Block{
+		Height:         c.Height,
+		Hash:           c.Hash,
+		Time:           c.Time.UTC(),
+		ProposerID:     propID,
+		ParticipantIDs: participantIDs,
+		MissingIDs:     missingIDs,
+		NilVoteIDs:     nilVoteIDs,
+		Messages:       messages,
+		FeeFrac:        feeFrac,
+		Fees:           fees,
+		Transactions:   transactions,
+		ValidatorsHash: c.ValidatorsHash,
+	}
+	return &block, nil
+}
+
+// storeValidatorSet inserts the validator set of the block described by given
+// commit, unless already present.
+func (sn *syncer) storeValidatorSet(ctx context.Context, c *TendermintCommit, vSet []*TendermintValidator) error {
+	ids, err := sn.validatorIDs.SetIDs(ctx, vSet)
+	if err != nil {
+		return errors.Wrap(err, "validator ID")
+	}
+	members := make([]ValidatorSetMember, len(vSet))
+	for i, v := range vSet {
+		members[i] = ValidatorSetMember{
+			ValidatorID:      ids[i],
+			VotingPower:      v.VotingPower,
+			ProposerPriority: v.ProposerPriority,
+		}
+	}
+	if err := sn.st.InsertValidatorSet(ctx, c.ValidatorsHash, c.Height, members); err != nil {
+		return errors.Wrapf(err, "insert validator set %X", c.ValidatorsHash)
 	}
+	return nil
+}
+
+// splitMessages returns all messages carried by msg. A batch message is split
+// into the messages it contains, any other message is returned as the only
+// element.
+func splitMessages(msg weave.Msg) ([]Message, error) {
+	list := []weave.Msg{msg}
+	if b, ok := msg.(batch.Msg); ok {
+		var err error
+		if list, err = b.MsgList(); err != nil {
+			return nil, err
+		}
+	}
+
+	messages := make([]Message, len(list))
+	for k, v := range list {
+		details, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		messages[k] = Message{
+			Path:    v.Path(),
+			Details: string(details),
+		}
+	}
+	return messages, nil
+}
+
+// messageDetails returns the JSON representation of the messages as stored
+// in the transaction message column. A batch message is represented by a list
+// of the messages it contains.
+func messageDetails(msg weave.Msg, messages []Message) (string, error) {
+	var (
+		res []byte
+		err error
+	)
+	if _, ok := msg.(batch.Msg); ok {
+		res, err = json.Marshal(messages)
+	} else {
+		res, err = json.Marshal(messages[0])
+	}
+	return string(res), err
 }
 
 // validatorsCache maintain a cache for the mapping of validator address to
 // that validator database ID.
 type validatorsCache struct {
 	cache map[string]int64
-	tmc   *TendermintClient
-	st    *Store
+	tmc   TendermintRPC
+	st    BlockStore
+	retry RetryPolicy
 }
 
-func newValidatorsCache(tmc *TendermintClient, st *Store) *validatorsCache {
+func newValidatorsCache(tmc TendermintRPC, st BlockStore, retry RetryPolicy) *validatorsCache {
 	return &validatorsCache{
 		cache: make(map[string]int64),
 		tmc:   tmc,
 		st:    st,
+		retry: retry,
 	}
 }
 
@@ -242,28 +924,56 @@ func (vc *validatorsCache) DatabaseID(ctx context.Context, address []byte, block
 		return 0, errors.Wrap(err, "query validator ID")
 	}
 
-	vs, err := Validators(ctx, vc.tmc, blockHeight)
+	var vs []*TendermintValidator
+	err := vc.retry.do(ctx, func() (err error) {
+		vs, err = Validators(ctx, vc.tmc, blockHeight)
+		return err
+	})
 	if err != nil {
 		return 0, errors.Wrap(err, "fetch validators")
 	}
 
 	for _, v := range vs {
-		if !bytes.Equal(v.Address, address) {
-			continue
+		if bytes.Equal(v.Address, address) {
+			return vc.insert(ctx, v)
 		}
-		id, err := vc.st.InsertValidator(ctx, v.PubKey, v.Address)
-		if err != nil {
-			return 0, errors.Wrap(err, "insert validator")
+	}
+	return 0, errors.Wrapf(ErrNotFound, "validator %x not present at height %d", address, blockHeight)
+}
+
+// SetIDs returns IDs of all validators from given set. Validators that are not
+// present in the database yet are registered.
+func (vc *validatorsCache) SetIDs(ctx context.Context, vs []*TendermintValidator) ([]int64, error) {
+	res := make([]int64, len(vs))
+	for i, v := range vs {
+		if id, ok := vc.cache[string(v.Address)]; ok {
+			res[i] = id
+			continue
 		}
 
-		vc.cache[string(address)] = id
-		return id, nil
+		switch id, err := vc.st.ValidatorAddressID(ctx, v.Address); {
+		case err == nil:
+			vc.cache[string(v.Address)] = id
+			res[i] = id
+		case ErrNotFound.Is(err):
+			id, err := vc.insert(ctx, v)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = id
+		default:
+			return nil, errors.Wrap(err, "query validator ID")
+		}
 	}
-	return 0, errors.Wrapf(ErrNotFound, "validator %x not present at height %d", address, blockHeight)
+	return res, nil
 }
 
-// StreamSync is expected to work similar to Sync but to use websocket and
-// never quit unless context was cancelled.
-func StreamSync(ctx context.Context) error {
-	return errors.New("not implemented")
+// insert registers the validator in the database and returns its ID.
+func (vc *validatorsCache) insert(ctx context.Context, v *TendermintValidator) (int64, error) {
+	id, err := vc.st.InsertValidator(ctx, v.PubKey, v.Address)
+	if err != nil {
+		return 0, errors.Wrap(err, "insert validator")
+	}
+	vc.cache[string(v.Address)] = id
+	return id, nil
 }
@@ -0,0 +1,635 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iov-one/block-metrics/pkg/errors"
+	"github.com/iov-one/block-metrics/pkg/tmtest"
+	bnsd "github.com/iov-one/weave/cmd/bnsd/app"
+	"github.com/iov-one/weave/coin"
+	"github.com/iov-one/weave/x/cash"
+)
+
+func TestSplitMessages(t *testing.T) {
+	send := &cash.SendMsg{
+		Source:      []byte{0x01},
+		Destination: []byte{0x02},
+		Amount:      coin.NewCoinp(1, 0, "IOV"),
+		Memo:        "test",
+	}
+
+	batch := &bnsd.ExecuteBatchMsg{
+		Messages: []bnsd.ExecuteBatchMsg_Union{
+			{Sum: &bnsd.ExecuteBatchMsg_Union_CashSendMsg{CashSendMsg: send}},
+			{Sum: &bnsd.ExecuteBatchMsg_Union_CashSendMsg{CashSendMsg: send}},
+		},
+	}
+
+	single, err := splitMessages(send)
+	if err != nil {
+		t.Fatalf("cannot split single message: %s", err)
+	}
+	if len(single) != 1 || single[0].Path != "cash/send" {
+		t.Fatalf("unexpected single message split: %#v", single)
+	}
+
+	messages, err := splitMessages(batch)
+	if err != nil {
+		t.Fatalf("cannot split batch message: %s", err)
+	}
+	if want := []Message{single[0], single[0]}; !reflect.DeepEqual(messages, want) {
+		t.Logf(" got %#v", messages)
+		t.Logf("want %#v", want)
+		t.Fatal("unexpected batch message split")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	}
+
+	cases := map[string]struct {
+		errs         []error
+		wantErr      *errors.Error
+		wantAttempts int
+	}{
+		"success": {
+			errs:         []error{nil},
+			wantAttempts: 1,
+		},
+		"success after transient failures": {
+			errs:         []error{ErrTimeout, ErrHeightNotAvailable, nil},
+			wantAttempts: 3,
+		},
+		"permanent failure": {
+			errs:         []error{ErrTimeout, ErrMethodNotFound, nil},
+			wantErr:      ErrMethodNotFound,
+			wantAttempts: 2,
+		},
+		"too many transient failures": {
+			errs:         []error{ErrInternal, ErrInternal, ErrInternal, nil},
+			wantErr:      ErrInternal,
+			wantAttempts: 3,
+		},
+	}
+
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			var attempts int
+			err := policy.do(context.Background(), func() error {
+				err := tc.errs[attempts]
+				attempts++
+				return err
+			})
+			if !tc.wantErr.Is(err) {
+				t.Fatalf("want %q error, got %q", tc.wantErr, err)
+			}
+			if attempts != tc.wantAttempts {
+				t.Fatalf("want %d attempts, got %d", tc.wantAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestSync(t *testing.T) {
+	t.Run("postgres", func(t *testing.T) {
+		db, cleanup := ensureDB(t)
+		defer cleanup()
+		testSync(t, NewStore(db))
+	})
+	t.Run("memory", func(t *testing.T) {
+		testSync(t, NewMemStore())
+	})
+}
+
+func testSync(t *testing.T, st BlockStore) {
+	var (
+		alice = tmtest.Validator{Address: []byte{0x01}, PubKey: []byte{0x11}, VotingPower: 10}
+		bob   = tmtest.Validator{Address: []byte{0x02}, PubKey: []byte{0x22}, VotingPower: 10}
+		carol = tmtest.Validator{Address: []byte{0x03}, PubKey: []byte{0x33}, VotingPower: 10}
+		dave  = tmtest.Validator{Address: []byte{0x04}, PubKey: []byte{0x44}, VotingPower: 10}
+	)
+	send := func(fee *coin.Coin) *bnsd.Tx {
+		return &bnsd.Tx{
+			Fees: &cash.FeeInfo{Payer: []byte{0x01}, Fees: fee},
+			Sum: &bnsd.Tx_CashSendMsg{CashSendMsg: &cash.SendMsg{
+				Source:      []byte{0x01},
+				Destination: []byte{0x02},
+				Amount:      coin.NewCoinp(1, 0, "IOV"),
+			}},
+		}
+	}
+
+	node := tmtest.NewNode()
+	defer node.Close()
+
+	blockTime := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	node.AddBlock(tmtest.Block{
+		Time:       blockTime,
+		Validators: []tmtest.Validator{alice, bob, carol},
+	})
+	// Carol missed the precommit.
+	node.AddBlock(tmtest.Block{
+		Time:     blockTime.Add(time.Second),
+		Proposer: bob.Address,
+		Signers:  [][]byte{alice.Address, bob.Address},
+	})
+	// Carol was replaced by Dave who did not sign yet.
+	node.AddBlock(tmtest.Block{
+		Time:       blockTime.Add(2 * time.Second),
+		Validators: []tmtest.Validator{alice, bob, dave},
+		Signers:    [][]byte{alice.Address, bob.Address},
+	})
+	node.AddBlock(tmtest.Block{
+		Time: blockTime.Add(3 * time.Second),
+		Txs: []*bnsd.Tx{
+			send(coin.NewCoinp(1, 500000000, "IOV")),
+			send(coin.NewCoinp(0, 250000000, "IOV")),
+			send(coin.NewCoinp(2, 0, "ETH")),
+			send(nil),
+		},
+	})
+	// Dave voted nil and Bob did not vote.
+	node.AddBlock(tmtest.Block{
+		Time:      blockTime.Add(4 * time.Second),
+		Signers:   [][]byte{alice.Address},
+		NilVoters: [][]byte{dave.Address},
+	})
+	// Nil votes are visible only in the tendermint 0.33+ format.
+	node.SetCommitFormat(tmtest.SignaturesFormat)
+
+	// A transient failure must be retried.
+	var failed int32
+	node.Hook(func(method string, params []string) *tmtest.RPCError {
+		if method == "commit" && len(params) > 0 && params[0] == "2" && atomic.CompareAndSwapInt32(&failed, 0, 1) {
+			return &tmtest.RPCError{Code: -32603, Message: "Internal error", Data: "boom"}
+		}
+		return nil
+	})
+
+	tmc, err := DialTendermint(node.URL())
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer tmc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conf := SyncConfig{
+		Retry: RetryPolicy{
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+		},
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := Sync(ctx, tmc, st, conf)
+		done <- err
+	}()
+
+	waitSynced(t, st, node, node.Height(), done)
+	cancel()
+	if err := <-done; !ErrInterrupted.Is(err) {
+		t.Fatalf("want interrupted error, got %v", err)
+	}
+	if atomic.LoadInt32(&failed) != 1 {
+		t.Fatal("scripted failure was not triggered")
+	}
+
+	ctx = context.Background()
+	ids := make(map[string]int64)
+	for name, v := range map[string]tmtest.Validator{"alice": alice, "bob": bob, "carol": carol, "dave": dave} {
+		id, err := st.ValidatorAddressID(ctx, v.Address)
+		if err != nil {
+			t.Fatalf("cannot get %s ID: %s", name, err)
+		}
+		ids[name] = id
+	}
+
+	cases := map[int64]struct {
+		proposer     int64
+		participants []int64
+		missing      []int64
+		nilVotes     []int64
+		validators   []int64
+		feeFrac      uint64
+		fees         coin.Coins
+	}{
+		1: {
+			proposer:     ids["alice"],
+			participants: []int64{ids["alice"], ids["bob"], ids["carol"]},
+			validators:   []int64{ids["alice"], ids["bob"], ids["carol"]},
+		},
+		2: {
+			proposer:     ids["bob"],
+			participants: []int64{ids["alice"], ids["bob"]},
+			missing:      []int64{ids["carol"]},
+			validators:   []int64{ids["alice"], ids["bob"], ids["carol"]},
+		},
+		3: {
+			proposer:     ids["alice"],
+			participants: []int64{ids["alice"], ids["bob"]},
+			missing:      []int64{ids["dave"]},
+			validators:   []int64{ids["alice"], ids["bob"], ids["dave"]},
+		},
+		4: {
+			proposer:     ids["alice"],
+			participants: []int64{ids["alice"], ids["bob"], ids["dave"]},
+			validators:   []int64{ids["alice"], ids["bob"], ids["dave"]},
+			feeFrac:      1750000000,
+			fees: coin.Coins{
+				coin.NewCoinp(2, 0, "ETH"),
+				coin.NewCoinp(1, 750000000, "IOV"),
+			},
+		},
+		5: {
+			proposer:     ids["alice"],
+			participants: []int64{ids["alice"]},
+			missing:      []int64{ids["bob"]},
+			nilVotes:     []int64{ids["dave"]},
+			validators:   []int64{ids["alice"], ids["bob"], ids["dave"]},
+		},
+	}
+
+	for height, want := range cases {
+		b, err := st.LoadBlock(ctx, height)
+		if err != nil {
+			t.Fatalf("cannot load block %d: %s", height, err)
+		}
+		if !bytes.Equal(b.Hash, node.BlockHash(height)) {
+			t.Errorf("block %d: unexpected hash %X", height, b.Hash)
+		}
+		if b.ProposerID != want.proposer {
+			t.Errorf("block %d: want proposer %d, got %d", height, want.proposer, b.ProposerID)
+		}
+		if !sameIDs(b.ParticipantIDs, want.participants) {
+			t.Errorf("block %d: want participants %v, got %v", height, want.participants, b.ParticipantIDs)
+		}
+		if !sameIDs(b.MissingIDs, want.missing) {
+			t.Errorf("block %d: want missing %v, got %v", height, want.missing, b.MissingIDs)
+		}
+		if !sameIDs(b.NilVoteIDs, want.nilVotes) {
+			t.Errorf("block %d: want nil votes %v, got %v", height, want.nilVotes, b.NilVoteIDs)
+		}
+		if b.FeeFrac != want.feeFrac {
+			t.Errorf("block %d: want fee %d, got %d", height, want.feeFrac, b.FeeFrac)
+		}
+		members, err := st.LoadValidatorSet(ctx, b.ValidatorsHash)
+		if err != nil {
+			t.Fatalf("block %d: cannot load validator set: %s", height, err)
+		}
+		var setIDs []int64
+		for _, m := range members {
+			if m.VotingPower != 10 {
+				t.Errorf("block %d: unexpected voting power %d", height, m.VotingPower)
+			}
+			setIDs = append(setIDs, m.ValidatorID)
+		}
+		if !sameIDs(setIDs, want.validators) {
+			t.Errorf("block %d: want validator set %v, got %v", height, want.validators, setIDs)
+		}
+		if len(b.Fees) != 0 || len(want.fees) != 0 {
+			if !reflect.DeepEqual(b.Fees, want.fees) {
+				t.Errorf("block %d: want fees %v, got %v", height, want.fees, b.Fees)
+			}
+		}
+	}
+}
+
+func TestSyncInterrupted(t *testing.T) {
+	node := tmtest.NewNode()
+	defer node.Close()
+	node.AddBlock(tmtest.Block{
+		Validators: []tmtest.Validator{{Address: []byte{0x01}, PubKey: []byte{0x11}, VotingPower: 10}},
+	})
+	for i := 0; i < 19; i++ {
+		node.AddBlock(tmtest.Block{})
+	}
+
+	tmc, err := DialTendermint(node.URL())
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer tmc.Close()
+
+	// Once cancelled, both the context and the prefetched results are
+	// ready to be received from. Repeat to cover both.
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		st := &cancellingStore{BlockStore: NewMemStore(), height: 5, cancel: cancel}
+		inserted, err := Sync(ctx, tmc, st, SyncConfig{})
+		cancel()
+		if !ErrInterrupted.Is(err) {
+			t.Fatalf("want interrupted error, got %v", err)
+		}
+		if inserted != 5 {
+			t.Fatalf("want 5 blocks inserted, got %d", inserted)
+		}
+	}
+}
+
+// cancellingStore is a store that cancels the synchronization right after
+// the block at given height is inserted.
+type cancellingStore struct {
+	BlockStore
+
+	height int64
+	cancel context.CancelFunc
+}
+
+func (s *cancellingStore) InsertBlock(ctx context.Context, b Block) error {
+	if err := s.BlockStore.InsertBlock(ctx, b); err != nil {
+		return err
+	}
+	if b.Height == s.height {
+		s.cancel()
+		// Give the prefetch time to notice the cancellation.
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil
+}
+
+// waitSynced blocks until the latest block in the store is the block of the
+// node at given height. It fails the test if the synchronization reported on
+// done stops earlier.
+func waitSynced(t *testing.T, st BlockStore, node *tmtest.Node, height int64, done <-chan error) {
+	t.Helper()
+
+	deadline := time.After(10 * time.Second)
+	for {
+		b, err := st.LatestBlock(context.Background())
+		if err == nil && b.Height == height && bytes.Equal(b.Hash, node.BlockHash(height)) {
+			return
+		}
+		if err != nil && !ErrNotFound.Is(err) {
+			t.Fatalf("cannot get latest block: %s", err)
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("sync stopped: %v", err)
+		case <-deadline:
+			t.Fatalf("block %d not synced in time", height)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+func TestStreamSync(t *testing.T) {
+	eachStore(t, func(t *testing.T, st BlockStore) {
+		node := tmtest.NewNode()
+		defer node.Close()
+
+		validators := []tmtest.Validator{
+			{Address: []byte{0x01}, PubKey: []byte{0x11}, VotingPower: 10},
+			{Address: []byte{0x02}, PubKey: []byte{0x22}, VotingPower: 10},
+		}
+		node.AddBlock(tmtest.Block{Validators: validators})
+		node.AddBlock(tmtest.Block{})
+
+		tmc, err := DialTendermint(node.URL())
+		if err != nil {
+			t.Fatalf("cannot dial: %s", err)
+		}
+		defer tmc.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := StreamSync(ctx, tmc, st, SyncConfig{})
+			done <- err
+		}()
+
+		// Blocks present before the subscription are caught up with.
+		waitSynced(t, st, node, 2, done)
+
+		// Blocks created later are announced by the subscription.
+		// Second validator misses the last one.
+		node.AddBlock(tmtest.Block{})
+		node.AddBlock(tmtest.Block{Signers: [][]byte{validators[0].Address}})
+		waitSynced(t, st, node, 4, done)
+
+		cancel()
+		if err := <-done; !ErrInterrupted.Is(err) {
+			t.Fatalf("want interrupted error, got %v", err)
+		}
+
+		for height := int64(1); height <= 4; height++ {
+			b, err := st.LoadBlock(context.Background(), height)
+			if err != nil {
+				t.Fatalf("cannot load block %d: %s", height, err)
+			}
+			if !bytes.Equal(b.Hash, node.BlockHash(height)) {
+				t.Errorf("block %d: unexpected hash %X", height, b.Hash)
+			}
+			if height == 4 && (len(b.ParticipantIDs) != 1 || len(b.MissingIDs) != 1) {
+				t.Errorf("block 4: want one participant and one missing, got %v and %v", b.ParticipantIDs, b.MissingIDs)
+			}
+		}
+	})
+}
+
+func TestSyncRewind(t *testing.T) {
+	cases := map[string]struct {
+		// agreed is the height of the last block on which both chains
+		// agree.
+		agreed int64
+		// height is the height of the chain served after the ten
+		// synced blocks were replaced.
+		height int64
+	}{
+		"last block diverged":                {agreed: 9, height: 12},
+		"several blocks":                     {agreed: 6, height: 12},
+		"all but the first one":              {agreed: 1, height: 12},
+		"all blocks":                         {agreed: 0, height: 12},
+		"same height":                        {agreed: 6, height: 10},
+		"shorter chain":                      {agreed: 4, height: 7},
+		"shorter chain, all blocks diverged": {agreed: 0, height: 3},
+	}
+
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			eachStore(t, func(t *testing.T, s BlockStore) {
+				testSyncRewind(t, s, tc.agreed, tc.height)
+			})
+		})
+	}
+}
+
+func testSyncRewind(t *testing.T, s BlockStore, agreed, height int64) {
+	validators := []tmtest.Validator{{Address: []byte{0x01}, PubKey: []byte{0x11}, VotingPower: 10}}
+
+	node := tmtest.NewNode()
+	defer node.Close()
+
+	blockTime := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		node.AddBlock(tmtest.Block{
+			Time:       blockTime.Add(time.Duration(i) * time.Second),
+			Validators: validators,
+		})
+	}
+
+	tmc, err := DialTendermint(node.URL())
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer tmc.Close()
+
+	st := &rewindRecorder{BlockStore: s}
+	runSync := func() uint {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var inserted uint
+		done := make(chan error, 1)
+		go func() {
+			n, err := Sync(ctx, tmc, st, SyncConfig{})
+			inserted = n
+			done <- err
+		}()
+		waitSynced(t, st, node, node.Height(), done)
+		cancel()
+		if err := <-done; !ErrInterrupted.Is(err) {
+			t.Fatalf("want interrupted error, got %v", err)
+		}
+		return inserted
+	}
+
+	if n := runSync(); n != 10 {
+		t.Fatalf("want 10 blocks inserted, got %d", n)
+	}
+	if len(st.rewinds) != 0 {
+		t.Fatalf("unexpected rewinds %v", st.rewinds)
+	}
+
+	// Replace all blocks above the agreed height with a new chain.
+	// Different block time results in a different hash.
+	node.Truncate(agreed)
+	for h := agreed + 1; h <= height; h++ {
+		node.AddBlock(tmtest.Block{
+			Time:       blockTime.Add(time.Duration(h) * time.Minute),
+			Validators: validators,
+		})
+	}
+
+	if n, want := runSync(), uint(height-agreed); n != want {
+		t.Errorf("want %d blocks inserted, got %d", want, n)
+	}
+	if want := []int64{agreed}; !reflect.DeepEqual(st.rewinds, want) {
+		t.Errorf("want rewinds to %v, got %v", want, st.rewinds)
+	}
+	if want := []int64{10 - agreed}; !reflect.DeepEqual(st.deleted, want) {
+		t.Errorf("want %v blocks deleted, got %v", want, st.deleted)
+	}
+	for h := int64(1); h <= height; h++ {
+		b, err := st.LoadBlock(context.Background(), h)
+		if err != nil {
+			t.Fatalf("cannot load block %d: %s", h, err)
+		}
+		if !bytes.Equal(b.Hash, node.BlockHash(h)) {
+			t.Errorf("block %d: unexpected hash %X", h, b.Hash)
+		}
+	}
+}
+
+// rewindRecorder is a store that records all calls to DeleteBlocksAbove.
+type rewindRecorder struct {
+	BlockStore
+
+	rewinds []int64
+	deleted []int64
+}
+
+func (r *rewindRecorder) DeleteBlocksAbove(ctx context.Context, blockHeight int64) (int64, error) {
+	n, err := r.BlockStore.DeleteBlocksAbove(ctx, blockHeight)
+	r.rewinds = append(r.rewinds, blockHeight)
+	r.deleted = append(r.deleted, n)
+	return n, err
+}
+
+// sameIDs returns true if both lists contain the same IDs, regardless of the
+// order.
+func sameIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[int64]int)
+	for _, id := range a {
+		counts[id]++
+	}
+	for _, id := range b {
+		counts[id]--
+		if counts[id] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSyncerPrefetch(t *testing.T) {
+	node := tmtest.NewNode()
+	defer node.Close()
+	node.AddBlock(tmtest.Block{
+		Validators: []tmtest.Validator{{Address: []byte{0x01}, PubKey: []byte{0x11}}},
+	})
+	for i := 0; i < 6; i++ {
+		node.AddBlock(tmtest.Block{})
+	}
+
+	// Failure of a single call within a batch must be recovered from by
+	// fetching that height again.
+	var failed int32
+	node.Hook(func(method string, params []string) *tmtest.RPCError {
+		if method == "block" && params[0] == "4" && atomic.CompareAndSwapInt32(&failed, 0, 1) {
+			return &tmtest.RPCError{Code: -32603, Message: "Internal error", Data: "boom"}
+		}
+		return nil
+	})
+
+	tmc, err := DialTendermint(node.URL())
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer tmc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sn := newSyncer(tmc, nil, SyncConfig{
+		FetchBatch: 3,
+		Retry: RetryPolicy{
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+		},
+	})
+	results := sn.prefetch(ctx, 2, 7)
+	for want := int64(2); want <= 7; want++ {
+		res := <-results
+		if res.err != nil {
+			t.Fatalf("height %d: %s", want, res.err)
+		}
+		if res.commit.Height != want || res.block.Height != want {
+			t.Fatalf("want height %d, got commit %d and block %d", want, res.commit.Height, res.block.Height)
+		}
+		if !bytes.Equal(res.commit.Hash, node.BlockHash(want)) {
+			t.Fatalf("height %d: unexpected hash %X", want, res.commit.Hash)
+		}
+	}
+	if _, ok := <-results; ok {
+		t.Fatal("results channel not closed")
+	}
+	if atomic.LoadInt32(&failed) != 1 {
+		t.Fatal("scripted failure was not triggered")
+	}
+}
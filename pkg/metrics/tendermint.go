@@ -7,6 +7,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,37 +21,156 @@ import (
 type TendermintClient struct {
 	idCnt uint64
 
+	url string
+
+	// wmu guards conn. It also serializes writes as websocket connection
+	// supports only one concurrent writer.
+	wmu sync.Mutex
+	// conn is nil while the connection is being reestablished.
 	conn *websocket.Conn
 
 	stop chan struct{}
 
 	mu   sync.Mutex
 	resp map[string]chan<- *jsonrpcResponse
+	// subs maps event correlation ID to the subscription.
+	subs map[string]*subscription
+	// recorder is nil unless responses are recorded.
+	recorder *Recorder
+}
+
+type subscription struct {
+	query  string
+	conf   SubscriptionConfig
+	events chan Event
+	// closed is guarded by the client mu.
+	closed bool
+}
+
+// close closes the events channel unless it is already closed. A
+// subscription can be released concurrently by the read loop, an
+// unsubscribe and a failed restore, so this is the only place where the
+// events channel is closed. This method must be called with the client mu
+// held.
+func (s *subscription) close() {
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
 }
 
 // DialTendermint returns a client that is maintains a websocket connection to
 // tendermint API. The websocket is used instead of standard HTTP connection to
 // lower the latency, bypass throttling and to allow subscription requests.
+//
+// If the connection is lost, all pending requests fail with ErrConnection
+// and the client redials with an exponential backoff. Once connected again,
+// all subscriptions are restored.
 func DialTendermint(websocketURL string) (*TendermintClient, error) {
-	c, _, err := websocket.DefaultDialer.Dial(websocketURL, nil)
+	conn, _, err := websocket.DefaultDialer.Dial(websocketURL, nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "dial")
 	}
 	cli := &TendermintClient{
-		conn: c,
+		url:  websocketURL,
 		stop: make(chan struct{}),
 		resp: make(map[string]chan<- *jsonrpcResponse),
+		subs: make(map[string]*subscription),
 	}
-	go cli.readLoop()
+	cli.setConn(conn)
+	go cli.readLoop(conn)
 	return cli, nil
 }
 
+const (
+	// closeTimeout is the time given to send the close message.
+	closeTimeout = time.Second
+
+	// pingPeriod is how often the connection is checked to be alive.
+	pingPeriod = 30 * time.Second
+
+	// pongWait is the time after which the connection is considered lost
+	// if nothing was received.
+	pongWait = 2 * pingPeriod
+
+	reconnectInitialBackoff = 500 * time.Millisecond
+	reconnectMaxBackoff     = 30 * time.Second
+)
+
+// Close terminates the connection. Tendermint is notified about the closing
+// so that all subscriptions can be released.
 func (c *TendermintClient) Close() error {
 	close(c.stop)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+
+	err := c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(closeTimeout))
+	if err != nil {
+		log.Printf("cannot send websocket close message: %s", err)
+	}
+
 	return c.conn.Close()
 }
 
-func (c *TendermintClient) readLoop() {
+// setConn configures given connection to be kept alive and makes it the one
+// used by the client. Connection is not set if the client was closed.
+func (c *TendermintClient) setConn(conn *websocket.Conn) bool {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	select {
+	case <-c.stop:
+		conn.Close()
+		return false
+	default:
+	}
+
+	// Without a read deadline, a connection silently dropped (ie. by a
+	// load balancer) would block the read loop forever.
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+			}
+			// WriteControl is safe to use concurrently with
+			// other writes.
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(closeTimeout)); err != nil {
+				return
+			}
+		}
+	}()
+
+	c.conn = conn
+	return true
+}
+
+func (c *TendermintClient) readLoop(conn *websocket.Conn) {
+	defer func() {
+		c.failPending(errors.Wrap(ErrConnection, "client closed"))
+
+		c.mu.Lock()
+		for id, sub := range c.subs {
+			sub.close()
+			delete(c.subs, id)
+		}
+		c.mu.Unlock()
+	}()
+
 	for {
 		select {
 		case <-c.stop:
@@ -57,55 +178,532 @@ func (c *TendermintClient) readLoop() {
 		default:
 		}
 
-		var resp jsonrpcResponse
-		if err := c.conn.ReadJSON(&resp); err != nil {
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-c.stop:
+				// Connection was closed.
+				return
+			default:
+			}
+
+			log.Printf("tendermint connection lost: %s", err)
+			if conn = c.reconnect(err); conn == nil {
+				return
+			}
+			continue
+		}
+
+		responses, err := unmarshalResponses(raw)
+		if err != nil {
 			log.Printf("cannot unmarshal JSONRPC message: %s", err)
 			continue
 		}
+		for _, resp := range responses {
+			c.dispatch(resp)
+		}
+	}
+}
 
-		c.mu.Lock()
-		respc, ok := c.resp[resp.CorrelationID]
-		delete(c.resp, resp.CorrelationID)
-		c.mu.Unlock()
+// unmarshalResponses decodes a single JSONRPC response or a batch of
+// responses.
+func unmarshalResponses(raw []byte) ([]*jsonrpcResponse, error) {
+	if b := bytes.TrimSpace(raw); len(b) > 0 && b[0] == '[' {
+		var responses []*jsonrpcResponse
+		if err := json.Unmarshal(b, &responses); err != nil {
+			return nil, err
+		}
+		return responses, nil
+	}
+	var resp jsonrpcResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return nil, err
+	}
+	return []*jsonrpcResponse{&resp}, nil
+}
+
+// dispatch delivers the response to the request or the subscription that
+// is waiting for it. Responses that nobody waits for are dropped.
+func (c *TendermintClient) dispatch(resp *jsonrpcResponse) {
+	c.mu.Lock()
+	respc, ok := c.resp[resp.CorrelationID]
+	delete(c.resp, resp.CorrelationID)
+	sub, isEvent := c.subs[resp.CorrelationID]
+	c.mu.Unlock()
+
+	if ok {
+		// repc is expected to be a buffered channel so this operation
+		// must never block.
+		respc <- resp
+		return
+	}
+	if !isEvent {
+		return
+	}
+
+	// Decode outside of the lock as it can take a while.
+	ev := decodeEvent(sub.query, resp)
+
+	c.mu.Lock()
+	// Subscription could have been cancelled in the meantime.
+	if c.subs[resp.CorrelationID] == sub {
+		c.deliver(resp.CorrelationID, sub, ev)
+	}
+	c.mu.Unlock()
+}
+
+// deliver sends the event to the subscriber, applying the overflow policy if
+// the subscriber is too slow. Never block the read loop because of a slow
+// subscriber. This method must be called with c.mu held.
+func (c *TendermintClient) deliver(id string, sub *subscription, ev Event) {
+	switch sub.conf.Overflow {
+	case DropOldest:
+		for {
+			select {
+			case sub.events <- ev:
+				return
+			default:
+			}
+			select {
+			case <-sub.events:
+				log.Printf("subscription %q buffer full, dropping oldest event", sub.query)
+			default:
+			}
+		}
+	case CloseOnOverflow:
+		select {
+		case sub.events <- ev:
+		default:
+			log.Printf("subscription %q buffer full, closing", sub.query)
+			delete(c.subs, id)
+			sub.close()
+			go c.unsubscribe(context.Background(), sub.query)
+		}
+	default:
+		select {
+		case sub.events <- ev:
+		default:
+			log.Printf("subscription %q buffer full, dropping event", sub.query)
+		}
+	}
+}
+
+// reconnect drops the current connection, fails all pending requests and
+// dials tendermint until a new connection is established. Subscriptions are
+// restored in the background. This method returns nil if the client was
+// closed.
+func (c *TendermintClient) reconnect(reason error) *websocket.Conn {
+	c.wmu.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	c.wmu.Unlock()
+
+	c.failPending(errors.Wrap(ErrConnection, reason.Error()))
+
+	backoff := reconnectInitialBackoff
+	for {
+		select {
+		case <-c.stop:
+			return nil
+		case <-time.After(backoff):
+		}
+
+		conn, _, err := websocket.DefaultDialer.Dial(c.url, nil)
+		if err == nil {
+			if !c.setConn(conn) {
+				return nil
+			}
+			log.Printf("tendermint connection reestablished")
+			go c.restoreSubscriptions()
+			return conn
+		}
+
+		log.Printf("cannot reconnect to tendermint, retrying in %s: %s", backoff, err)
+		backoff *= 2
+		if backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+}
+
+// failPending completes all requests that are waiting for a response with
+// given error.
+func (c *TendermintClient) failPending(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, respc := range c.resp {
+		// respc is a buffered channel and only one response is
+		// ever sent so this operation must never block.
+		respc <- &jsonrpcResponse{CorrelationID: id, err: err}
+		delete(c.resp, id)
+	}
+}
+
+// restoreSubscriptions subscribes again for all events that the client was
+// subscribed for before the connection was lost. Subscription that cannot be
+// restored is closed.
+func (c *TendermintClient) restoreSubscriptions() {
+	c.mu.Lock()
+	subs := make([]*subscription, 0, len(c.subs))
+	for id, sub := range c.subs {
+		subs = append(subs, sub)
+		delete(c.subs, id)
+	}
+	c.mu.Unlock()
+
+	for _, sub := range subs {
+		if err := c.register(context.Background(), sub); err != nil {
+			log.Printf("cannot restore %q subscription: %s", sub.query, err)
+			c.mu.Lock()
+			sub.close()
+			c.mu.Unlock()
+		}
+	}
+}
+
+// Subscribe registers for events matching given query, for example
+// "tm.event='NewBlock'". Events are buffered and dropped if the subscriber is
+// too slow. Use SubscribeWith to change that behaviour.
+//
+// Returned channel is closed when the client is closed, the subscription is
+// cancelled or if the subscription cannot be restored after the connection
+// was lost.
+func (c *TendermintClient) Subscribe(ctx context.Context, query string) (<-chan Event, error) {
+	return c.SubscribeWith(ctx, query, SubscriptionConfig{})
+}
 
-		if ok {
-			// repc is expected to be a buffered channel so this
-			// operation must never block.
-			respc <- &resp
+// SubscribeWith works as Subscribe but allows to configure how events are
+// delivered.
+func (c *TendermintClient) SubscribeWith(ctx context.Context, query string, conf SubscriptionConfig) (<-chan Event, error) {
+	conf = conf.withDefaults()
+	sub := &subscription{
+		query:  query,
+		conf:   conf,
+		events: make(chan Event, conf.Buffer),
+	}
+	if err := c.register(ctx, sub); err != nil {
+		return nil, errors.Wrap(err, "subscribe")
+	}
+	return sub.events, nil
+}
+
+// Unsubscribe cancels the subscription for given query. Its events channel
+// is closed.
+func (c *TendermintClient) Unsubscribe(ctx context.Context, query string) error {
+	var found bool
+	c.mu.Lock()
+	for id, sub := range c.subs {
+		if sub.query == query {
+			delete(c.subs, id)
+			sub.close()
+			found = true
 		}
 	}
+	c.mu.Unlock()
+
+	if !found {
+		return errors.Wrapf(ErrNotFound, "no %q subscription", query)
+	}
+	return c.unsubscribe(ctx, query)
+}
+
+// unsubscribe notifies tendermint that events for given query are no longer
+// needed.
+func (c *TendermintClient) unsubscribe(ctx context.Context, query string) error {
+	var result struct{}
+	if err := c.DoContext(ctx, "unsubscribe", &result, query); err != nil {
+		return errors.Wrap(err, "unsubscribe")
+	}
+	return nil
+}
+
+// register sends the subscribe request for given subscription and starts
+// routing its events. Tendermint delivers each event as a JSONRPC message
+// with a correlation ID of the subscribe request suffixed with "#event".
+func (c *TendermintClient) register(ctx context.Context, sub *subscription) error {
+	id := c.nextID()
+
+	c.mu.Lock()
+	c.subs[id+"#event"] = sub
+	c.mu.Unlock()
+
+	var result struct{}
+	if err := c.call(ctx, id, "subscribe", &result, sub.query); err != nil {
+		c.mu.Lock()
+		delete(c.subs, id+"#event")
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Record makes the client write all responses received to fixture files
+// using given recorder. Pass nil to stop recording.
+func (c *TendermintClient) Record(r *Recorder) {
+	c.mu.Lock()
+	c.recorder = r
+	c.mu.Unlock()
+}
+
+func (c *TendermintClient) nextID() string {
+	return fmt.Sprint(atomic.AddUint64(&c.idCnt, 1))
 }
 
 // Do makes a jsonrpc call. This method is safe for concurrent calls.
 //
 // Use API as described in https://tendermint.com/rpc/
 func (c *TendermintClient) Do(method string, dest interface{}, args ...interface{}) error {
+	return c.DoContext(context.Background(), method, dest, args...)
+}
+
+// DoContext makes a jsonrpc call that is abandoned when the context is
+// cancelled. If the context has no deadline, a default timeout for the method
+// is used. This method is safe for concurrent calls.
+//
+// Use API as described in https://tendermint.com/rpc/
+func (c *TendermintClient) DoContext(ctx context.Context, method string, dest interface{}, args ...interface{}) error {
+	return c.call(ctx, c.nextID(), method, dest, args...)
+}
+
+// methodTimeouts defines how long to wait for a response to a request if the
+// context does not define a deadline.
+var methodTimeouts = map[string]time.Duration{
+	"abci_info":   10 * time.Second,
+	"subscribe":   10 * time.Second,
+	"unsubscribe": 10 * time.Second,
+	"commit":      30 * time.Second,
+	"validators":  30 * time.Second,
+	"block":       time.Minute,
+}
+
+// defaultMethodTimeout is used for methods not present in methodTimeouts.
+const defaultMethodTimeout = 30 * time.Second
+
+func methodTimeout(method string) time.Duration {
+	if t, ok := methodTimeouts[method]; ok {
+		return t
+	}
+	return defaultMethodTimeout
+}
+
+func (c *TendermintClient) call(ctx context.Context, id string, method string, dest interface{}, args ...interface{}) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, methodTimeout(method))
+		defer cancel()
+	}
+
+	req := newJSONRPCRequest(id, method, args)
+	respcs, recorder, err := c.send(ctx, req, req)
+	if err != nil {
+		return err
+	}
+	resp, err := c.await(ctx, req, respcs[0])
+	if err != nil {
+		return err
+	}
+	if recorder != nil {
+		if err := recorder.record(method, req.Params, resp); err != nil {
+			log.Printf("cannot record %s response: %s", method, err)
+		}
+	}
+	return resp.decode(dest)
+}
+
+// send registers all requests as waiting for a response and writes the
+// payload to the connection. It returns a response channel for each request
+// and the recorder that must be used for the responses, if any.
+func (c *TendermintClient) send(ctx context.Context, payload interface{}, reqs ...jsonrpcRequest) ([]chan *jsonrpcResponse, *Recorder, error) {
+	respcs := make([]chan *jsonrpcResponse, len(reqs))
+	c.mu.Lock()
+	for i, req := range reqs {
+		respcs[i] = make(chan *jsonrpcResponse, 1)
+		c.resp[req.CorrelationID] = respcs[i]
+	}
+	recorder := c.recorder
+	c.mu.Unlock()
+
+	var err error
+	c.wmu.Lock()
+	if c.conn == nil {
+		err = errors.Wrap(ErrConnection, "not connected")
+	} else {
+		deadline, _ := ctx.Deadline()
+		c.conn.SetWriteDeadline(deadline)
+		if werr := c.conn.WriteJSON(payload); werr != nil {
+			err = errors.Wrapf(ErrConnection, "write JSON: %s", werr)
+		}
+	}
+	c.wmu.Unlock()
+	if err != nil {
+		c.forget(reqs...)
+		return nil, nil, err
+	}
+	return respcs, recorder, nil
+}
+
+// await returns the response to given request. It fails if the context is
+// done first.
+func (c *TendermintClient) await(ctx context.Context, req jsonrpcRequest, respc <-chan *jsonrpcResponse) (*jsonrpcResponse, error) {
+	select {
+	case resp := <-respc:
+		return resp, nil
+	case <-ctx.Done():
+		// Response will not be consumed anymore.
+		c.forget(req)
+
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errors.Wrapf(ErrTimeout, "no %s response", req.Method)
+		}
+		return nil, errors.Wrapf(ctx.Err(), "%s request", req.Method)
+	}
+}
+
+// forget stops waiting for responses to given requests.
+func (c *TendermintClient) forget(reqs ...jsonrpcRequest) {
+	c.mu.Lock()
+	for _, req := range reqs {
+		delete(c.resp, req.CorrelationID)
+	}
+	c.mu.Unlock()
+}
+
+// DoBatch makes all calls using a single JSONRPC batch request. Responses are
+// matched with calls by the correlation ID and the result of each call is
+// stored in its Err and Dest fields. If the context has no deadline, the
+// longest default timeout of all methods is used. The returned error is set
+// only if the batch as a whole failed, for example because the connection was
+// lost. This method is safe for concurrent calls.
+func (c *TendermintClient) DoBatch(ctx context.Context, calls []*BatchCall) error {
+	if len(calls) == 0 {
+		return nil
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, batchTimeout(calls))
+		defer cancel()
+	}
+
+	reqs := make([]jsonrpcRequest, len(calls))
+	for i, call := range calls {
+		reqs[i] = newJSONRPCRequest(c.nextID(), call.Method, call.Args)
+	}
+	respcs, recorder, err := c.send(ctx, reqs, reqs...)
+	if err != nil {
+		return errors.Wrap(err, "batch")
+	}
+
+	for i, req := range reqs {
+		resp, err := c.await(ctx, req, respcs[i])
+		if err != nil {
+			c.forget(reqs[i+1:]...)
+			return errors.Wrap(err, "batch")
+		}
+		if recorder != nil {
+			if err := recorder.record(req.Method, req.Params, resp); err != nil {
+				log.Printf("cannot record %s response: %s", req.Method, err)
+			}
+		}
+		calls[i].Err = resp.decode(calls[i].Dest)
+	}
+	return nil
+}
+
+// BatchCall is a single call made as part of a batch request.
+type BatchCall struct {
+	Method string
+	Args   []interface{}
+	// Dest is where the result is unmarshaled into.
+	Dest interface{}
+	// Err is set to the call error once the batch request completes.
+	Err error
+}
+
+// batchTimeout returns the longest timeout of all methods called.
+func batchTimeout(calls []*BatchCall) time.Duration {
+	var timeout time.Duration
+	for _, call := range calls {
+		if t := methodTimeout(call.Method); t > timeout {
+			timeout = t
+		}
+	}
+	return timeout
+}
+
+// TendermintRPC is implemented by clients that can make tendermint JSONRPC
+// calls. It covers all calls required to synchronize blocks.
+type TendermintRPC interface {
+	// DoContext makes a jsonrpc call that is abandoned when the context
+	// is cancelled. This method must be safe for concurrent calls.
+	DoContext(ctx context.Context, method string, dest interface{}, args ...interface{}) error
+
+	// Close releases all resources.
+	Close() error
+}
+
+// TendermintBatchRPC is implemented by clients that can send several calls
+// within a single batch request.
+type TendermintBatchRPC interface {
+	TendermintRPC
+
+	// DoBatch makes all calls using a single request. The result of each
+	// call is stored in the call. The returned error is set only if the
+	// batch as a whole failed. This method must be safe for concurrent
+	// calls.
+	DoBatch(ctx context.Context, calls []*BatchCall) error
+}
+
+var (
+	_ TendermintBatchRPC = (*TendermintClient)(nil)
+	_ TendermintBatchRPC = (*TendermintHTTPClient)(nil)
+)
+
+// ConnectTendermint returns a tendermint client that is using the protocol
+// as specified by the URL scheme. Use ws:// or wss:// for the websocket
+// client and http:// or https:// for the plain HTTP client. Use file:// with
+// a fixture directory path to replay recorded responses.
+func ConnectTendermint(rawurl string) (TendermintRPC, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid URL")
+	}
+	switch u.Scheme {
+	case "ws", "wss":
+		return DialTendermint(rawurl)
+	case "http", "https":
+		return NewTendermintHTTPClient(rawurl), nil
+	case "file":
+		// Allow relative paths, for example file://testdata/mainnet
+		return NewTendermintReplay(u.Host + u.Path), nil
+	default:
+		return nil, errors.Wrapf(ErrConnection, "unsupported scheme %q", u.Scheme)
+	}
+}
+
+func newJSONRPCRequest(id string, method string, args []interface{}) jsonrpcRequest {
 	params := make([]string, len(args))
 	for i, v := range args {
 		params[i] = fmt.Sprint(v)
 	}
-	req := jsonrpcRequest{
+	return jsonrpcRequest{
 		ProtocolVersion: "2.0",
-		CorrelationID:   fmt.Sprint(atomic.AddUint64(&c.idCnt, 1)),
+		CorrelationID:   id,
 		Method:          method,
 		Params:          params,
 	}
+}
 
-	respc := make(chan *jsonrpcResponse, 1)
-	c.mu.Lock()
-	c.resp[req.CorrelationID] = respc
-	c.mu.Unlock()
-
-	if err := c.conn.WriteJSON(req); err != nil {
-		return errors.Wrap(err, "write JSON")
+// decode unmarshals the result into dest or returns the error if the
+// request failed.
+func (resp *jsonrpcResponse) decode(dest interface{}) error {
+	if resp.err != nil {
+		return resp.err
 	}
-
-	resp := <-respc
-
 	if resp.Error != nil {
-		return errors.Wrapf(ErrFailedResponse,
-			"%d: %s",
-			resp.Error.Code, resp.Error.Message)
+		return resp.Error.Err()
 	}
 	if err := json.Unmarshal(resp.Result, dest); err != nil {
 		return errors.Wrap(err, "cannot unmarshal result")
@@ -124,25 +722,108 @@ type jsonrpcResponse struct {
 	ProtocolVersion string `json:"jsonrpc"`
 	CorrelationID   string `json:"id"`
 	Result          json.RawMessage
-	Error           *struct {
-		Code    int64
-		Message string
+	Error           *jsonrpcError
+
+	// err is set when the response was not received because of a client
+	// side failure.
+	err error
+}
+
+type jsonrpcError struct {
+	Code    int64  `json:"code"`
+	Message string `json:"message"`
+	Data    string `json:"data,omitempty"`
+}
+
+// JSONRPC error codes as defined by the specification and used by
+// tendermint.
+const (
+	jsonrpcInvalidParams  = -32602
+	jsonrpcMethodNotFound = -32601
+	jsonrpcInternalError  = -32603
+	jsonrpcServerError    = -32000
+)
+
+// Err returns an error of a kind matching the failure described by the JSONRPC
+// error.
+func (e *jsonrpcError) Err() error {
+	kind := ErrFailedResponse
+	data := strings.ToLower(e.Data)
+	switch {
+	case e.Code == jsonrpcMethodNotFound:
+		kind = ErrMethodNotFound
+	case strings.Contains(data, "must be less than or equal to the current blockchain height"),
+		strings.Contains(data, "is not available"),
+		strings.Contains(data, "could not find results for height"):
+		kind = ErrHeightNotAvailable
+	case strings.Contains(data, "timed out"), strings.Contains(data, "timeout"):
+		kind = ErrTimeout
+	case strings.Contains(data, "page should be within"):
+		kind = ErrPageOutOfRange
+	case e.Code == jsonrpcInvalidParams:
+		kind = ErrInvalidParams
+	case e.Code == jsonrpcInternalError, e.Code == jsonrpcServerError:
+		kind = ErrInternal
 	}
+
+	if e.Data == "" {
+		return errors.Wrapf(kind, "%d: %s", e.Code, e.Message)
+	}
+	return errors.Wrapf(kind, "%d: %s: %s", e.Code, e.Message, e.Data)
 }
 
 var (
+	// ErrFailedResponse is returned when tendermint responded with an
+	// error. All tendermint error kinds are ErrFailedResponse as well.
 	ErrFailedResponse = errors.New("failed response")
+
+	// ErrHeightNotAvailable is returned when the requested height is not
+	// (yet) available on the node.
+	ErrHeightNotAvailable = errors.Wrap(ErrFailedResponse, "height not available")
+
+	// ErrMethodNotFound is returned when the node does not support the
+	// requested method.
+	ErrMethodNotFound = errors.Wrap(ErrFailedResponse, "method not found")
+
+	// ErrInvalidParams is returned when the request parameters were not
+	// accepted by the node.
+	ErrInvalidParams = errors.Wrap(ErrFailedResponse, "invalid params")
+
+	// ErrPageOutOfRange is returned when the requested page of a paginated
+	// result does not exist.
+	ErrPageOutOfRange = errors.Wrap(ErrFailedResponse, "page out of range")
+
+	// ErrTimeout is returned when the node did not manage to complete the
+	// request in time or the response was not received in time.
+	ErrTimeout = errors.Wrap(ErrFailedResponse, "timeout")
+
+	// ErrInternal is returned when the node failed to process the request
+	// because of an internal error.
+	ErrInternal = errors.Wrap(ErrFailedResponse, "internal")
 )
 
+// ErrConnection is returned when a request cannot be completed because
+// the connection to tendermint is not available.
+var ErrConnection = errors.New("connection")
+
+// IsTransient returns true if the request that failed with given error can
+// be expected to succeed if repeated later.
+func IsTransient(err error) bool {
+	return ErrConnection.Is(err) ||
+		ErrHeightNotAvailable.Is(err) ||
+		ErrTimeout.Is(err) ||
+		ErrInternal.Is(err)
+}
+
 // AbciInfo returns abci_info.
-func AbciInfo(c *TendermintClient) (*ABCIInfo, error) {
+func AbciInfo(ctx context.Context, c TendermintRPC) (*ABCIInfo, error) {
 	var payload struct {
 		Response struct {
 			LastBlockHeight sint64 `json:"last_block_height"`
 		} `json:"response"`
 	}
 
-	if err := c.Do("abci_info", &payload); err != nil {
+	if err := c.DoContext(ctx, "abci_info", &payload); err != nil {
 		return nil, errors.Wrap(err, "query tendermint")
 	}
 
@@ -154,32 +835,69 @@ type ABCIInfo struct {
 }
 
 // Validators return all validators as represented on the block at given
-// height.
-func Validators(ctx context.Context, c *TendermintClient, blockHeight int64) ([]*TendermintValidator, error) {
-	var payload struct {
-		Validators []struct {
-			Address hexstring
-			PubKey  struct {
-				Value []byte
-			} `json:"pub_key"`
-		}
-	}
-	if err := c.Do("validators", &payload, blockHeight); err != nil {
-		return nil, errors.Wrap(err, "query tendermint")
-	}
+// height. All pages are fetched if the set is paginated.
+func Validators(ctx context.Context, c TendermintRPC, blockHeight int64) ([]*TendermintValidator, error) {
 	var validators []*TendermintValidator
-	for _, v := range payload.Validators {
-		validators = append(validators, &TendermintValidator{
-			Address: v.Address,
-			PubKey:  v.PubKey.Value,
-		})
+	for page := 1; ; page++ {
+		var payload struct {
+			Validators []struct {
+				Address hexstring
+				PubKey  struct {
+					Value []byte
+				} `json:"pub_key"`
+				VotingPower      sint64 `json:"voting_power"`
+				ProposerPriority sint64 `json:"proposer_priority"`
+			}
+			// Total is provided only by tendermint 0.33+.
+			Total *sint64 `json:"total"`
+		}
+		err := c.DoContext(ctx, "validators", &payload, blockHeight, page, validatorsPerPage)
+		if page == 1 && ErrInvalidParams.Is(err) {
+			// Tendermint before 0.32 does not support pagination
+			// and returns all validators at once.
+			err = c.DoContext(ctx, "validators", &payload, blockHeight)
+			page = -1
+		}
+		if page > 1 && ErrPageOutOfRange.Is(err) {
+			// Tendermint before 0.33 does not report the total
+			// count, so the previous page being full does not
+			// mean there are more validators.
+			return validators, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "query tendermint")
+		}
+		for _, v := range payload.Validators {
+			validators = append(validators, &TendermintValidator{
+				Address:          v.Address,
+				PubKey:           v.PubKey.Value,
+				VotingPower:      v.VotingPower.Int64(),
+				ProposerPriority: v.ProposerPriority.Int64(),
+			})
+		}
+
+		switch {
+		case page < 0:
+			return validators, nil
+		case payload.Total != nil && int64(len(validators)) >= payload.Total.Int64():
+			return validators, nil
+		case len(payload.Validators) < validatorsPerPage:
+			return validators, nil
+		}
 	}
-	return validators, nil
 }
 
+// validatorsPerPage is the maximum page size allowed by tendermint.
+const validatorsPerPage = 100
+
 type TendermintValidator struct {
 	Address []byte
 	PubKey  []byte
+	// VotingPower is the weight of the validator vote.
+	VotingPower int64
+	// ProposerPriority decides when the validator proposes a block. It
+	// changes with every block.
+	ProposerPriority int64
 }
 
 // ValidatorAddresses extracts just the addresses of out a signing set
@@ -212,46 +930,89 @@ func contains(haystack [][]byte, needle []byte) bool {
 	return false
 }
 
-func Commit(ctx context.Context, c *TendermintClient, height int64) (*TendermintCommit, error) {
-	var payload struct {
-		SignedHeader struct {
-			Header struct {
-				Height          sint64    `json:"height"`
-				Time            time.Time `json:"time"`
-				ProposerAddress hexstring `json:"proposer_address"`
-				ValidatorsHash  hexstring `json:"validators_hash"`
-			} `json:"header"`
-			Commit struct {
-				BlockID struct {
+func Commit(ctx context.Context, c TendermintRPC, height int64) (*TendermintCommit, error) {
+	var payload commitPayload
+	if err := c.DoContext(ctx, "commit", &payload, height); err != nil {
+		return nil, errors.Wrap(err, "query tendermint")
+	}
+	return payload.commit(), nil
+}
+
+// commitPayload is the result of the commit call. Tendermint 0.33 replaced
+// precommits with signatures, so both formats are declared.
+type commitPayload struct {
+	SignedHeader struct {
+		Header struct {
+			Height          sint64    `json:"height"`
+			Time            time.Time `json:"time"`
+			ProposerAddress hexstring `json:"proposer_address"`
+			ValidatorsHash  hexstring `json:"validators_hash"`
+		} `json:"header"`
+		Commit struct {
+			BlockID struct {
+				Hash hexstring `json:"hash"`
+			} `json:"block_id"`
+			// Precommits is used by tendermint 0.32 and older.
+			// Validators that did not vote are represented by null.
+			Precommits []*struct {
+				ValidatorAddress hexstring `json:"validator_address"`
+				BlockID          struct {
 					Hash hexstring `json:"hash"`
 				} `json:"block_id"`
-				Precommits []*struct {
-					ValidatorAddress hexstring `json:"validator_address"`
-				} `json:"precommits"`
-			} `json:"commit"`
-		} `json:"signed_header"`
-	}
+			} `json:"precommits"`
+			// Signatures is used by tendermint 0.33 and newer.
+			Signatures []struct {
+				BlockIDFlag      blockIDFlag `json:"block_id_flag"`
+				ValidatorAddress hexstring   `json:"validator_address"`
+			} `json:"signatures"`
+		} `json:"commit"`
+	} `json:"signed_header"`
+}
 
-	if err := c.Do("commit", &payload, height); err != nil {
-		return nil, errors.Wrap(err, "query tendermint")
-	}
+// blockIDFlag describes the vote of a validator in tendermint 0.33+ commits.
+type blockIDFlag int
+
+const (
+	blockIDFlagAbsent blockIDFlag = 1
+	blockIDFlagCommit blockIDFlag = 2
+	blockIDFlagNil    blockIDFlag = 3
+)
 
+func (payload *commitPayload) commit() *TendermintCommit {
+	header := payload.SignedHeader.Header
+	c := payload.SignedHeader.Commit
 	commit := TendermintCommit{
-		Height:          payload.SignedHeader.Header.Height.Int64(),
-		Hash:            payload.SignedHeader.Commit.BlockID.Hash,
-		Time:            payload.SignedHeader.Header.Time.UTC(),
-		ProposerAddress: payload.SignedHeader.Header.ProposerAddress,
-		ValidatorsHash:  payload.SignedHeader.Header.ValidatorsHash,
+		Height:          header.Height.Int64(),
+		Hash:            c.BlockID.Hash,
+		Time:            header.Time.UTC(),
+		ProposerAddress: header.ProposerAddress,
+		ValidatorsHash:  header.ValidatorsHash,
+	}
+
+	if c.Signatures != nil {
+		for _, sig := range c.Signatures {
+			switch sig.BlockIDFlag {
+			case blockIDFlagCommit:
+				commit.ParticipantAddresses = append(commit.ParticipantAddresses, sig.ValidatorAddress)
+			case blockIDFlagNil:
+				commit.NilVoteAddresses = append(commit.NilVoteAddresses, sig.ValidatorAddress)
+			}
+		}
+		return &commit
 	}
 
-	for _, pc := range payload.SignedHeader.Commit.Precommits {
+	for _, pc := range c.Precommits {
 		if pc == nil {
 			continue
 		}
+		if len(pc.BlockID.Hash) == 0 || !bytes.Equal(pc.BlockID.Hash, c.BlockID.Hash) {
+			commit.NilVoteAddresses = append(commit.NilVoteAddresses, pc.ValidatorAddress)
+			continue
+		}
 		commit.ParticipantAddresses = append(commit.ParticipantAddresses, pc.ValidatorAddress)
 	}
 
-	return &commit, nil
+	return &commit
 }
 
 type TendermintCommit struct {
@@ -261,25 +1022,33 @@ type TendermintCommit struct {
 	ProposerAddress      []byte
 	ValidatorsHash       []byte
 	ParticipantAddresses [][]byte
+	// NilVoteAddresses are the validators that voted for nil instead of
+	// this block.
+	NilVoteAddresses [][]byte
 }
 
-func FetchBlock(ctx context.Context, c *TendermintClient, height int64) (*TendermintBlock, error) {
-	var payload struct {
-		Block struct {
-			Header struct {
-				Height sint64    `json:"height"`
-				Time   time.Time `json:"time"`
-			} `json:"header"`
-			Data struct {
-				Txs [][]byte `json:"txs"`
-			} `json:"data"`
-		} `json:"block"`
-	}
-
-	if err := c.Do("block", &payload, height); err != nil {
+func FetchBlock(ctx context.Context, c TendermintRPC, height int64) (*TendermintBlock, error) {
+	var payload blockPayload
+	if err := c.DoContext(ctx, "block", &payload, height); err != nil {
 		return nil, errors.Wrap(err, "query tendermint")
 	}
+	return payload.block()
+}
+
+// blockPayload is the result of the block call.
+type blockPayload struct {
+	Block struct {
+		Header struct {
+			Height sint64    `json:"height"`
+			Time   time.Time `json:"time"`
+		} `json:"header"`
+		Data struct {
+			Txs [][]byte `json:"txs"`
+		} `json:"data"`
+	} `json:"block"`
+}
 
+func (payload *blockPayload) block() (*TendermintBlock, error) {
 	block := TendermintBlock{
 		Height: payload.Block.Header.Height.Int64(),
 		Time:   payload.Block.Header.Time.UTC(),
@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/iov-one/block-metrics/pkg/errors"
+)
+
+// TendermintHTTPClient makes tendermint JSONRPC calls using plain HTTP POST
+// requests. Use it instead of TendermintClient when the node does not expose
+// the websocket endpoint. Subscriptions are not supported.
+//
+// The GET form of the API (/method?arg=value) is not supported. It requires
+// the arguments to be named, and it cannot carry batch requests.
+type TendermintHTTPClient struct {
+	idCnt uint64
+
+	url string
+	cli *http.Client
+
+	mu sync.Mutex
+	// recorder is nil unless responses are recorded.
+	recorder *Recorder
+}
+
+// NewTendermintHTTPClient returns a client that sends JSONRPC requests to
+// the tendermint API available at given URL.
+func NewTendermintHTTPClient(url string) *TendermintHTTPClient {
+	return &TendermintHTTPClient{
+		url: url,
+		cli: &http.Client{},
+	}
+}
+
+// Close releases all idle connections.
+func (c *TendermintHTTPClient) Close() error {
+	c.cli.CloseIdleConnections()
+	return nil
+}
+
+// Record makes the client write all responses received to fixture files
+// using given recorder. Pass nil to stop recording.
+func (c *TendermintHTTPClient) Record(r *Recorder) {
+	c.mu.Lock()
+	c.recorder = r
+	c.mu.Unlock()
+}
+
+// DoContext makes a jsonrpc call that is abandoned when the context is
+// cancelled. If the context has no deadline, a default timeout for the method
+// is used. This method is safe for concurrent calls.
+//
+// Use API as described in https://tendermint.com/rpc/
+func (c *TendermintHTTPClient) DoContext(ctx context.Context, method string, dest interface{}, args ...interface{}) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, methodTimeout(method))
+		defer cancel()
+	}
+
+	id := fmt.Sprint(atomic.AddUint64(&c.idCnt, 1))
+	rpcReq := newJSONRPCRequest(id, method, args)
+	raw, err := c.post(ctx, method, rpcReq)
+	if err != nil {
+		return err
+	}
+	var payload jsonrpcResponse
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return errors.Wrap(err, "cannot unmarshal JSONRPC message")
+	}
+
+	c.mu.Lock()
+	recorder := c.recorder
+	c.mu.Unlock()
+	if recorder != nil {
+		if err := recorder.record(method, rpcReq.Params, &payload); err != nil {
+			log.Printf("cannot record %s response: %s", method, err)
+		}
+	}
+	return payload.decode(dest)
+}
+
+// post sends the payload and returns the response body. The name is used to
+// describe the request in errors.
+func (c *TendermintHTTPClient) post(ctx context.Context, name string, payload interface{}) ([]byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal request")
+	}
+
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.cli.Do(req.WithContext(ctx))
+	if err != nil {
+		switch ctx.Err() {
+		case nil:
+			return nil, errors.Wrapf(ErrConnection, "%s request: %s", name, err)
+		case context.DeadlineExceeded:
+			return nil, errors.Wrapf(ErrTimeout, "no %s response", name)
+		default:
+			return nil, errors.Wrapf(ctx.Err(), "%s request", name)
+		}
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTTPResponseSize))
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errors.Wrapf(ErrTimeout, "no %s response", name)
+		}
+		return nil, errors.Wrapf(ErrConnection, "read %s response: %s", name, err)
+	}
+	// A proxy can respond with a non JSONRPC error page.
+	if resp.StatusCode != http.StatusOK && !json.Valid(raw) {
+		return nil, errors.Wrapf(ErrConnection, "%s response status %d", name, resp.StatusCode)
+	}
+	return raw, nil
+}
+
+// maxHTTPResponseSize limits the size of a response body that is read.
+const maxHTTPResponseSize = 64 << 20
+
+// DoBatch makes all calls using a single JSONRPC batch request. Responses are
+// matched with calls by the correlation ID and the result of each call is
+// stored in its Err and Dest fields. If the context has no deadline, the
+// longest default timeout of all methods is used. The returned error is set
+// only if the batch as a whole failed. This method is safe for concurrent
+// calls.
+func (c *TendermintHTTPClient) DoBatch(ctx context.Context, calls []*BatchCall) error {
+	if len(calls) == 0 {
+		return nil
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, batchTimeout(calls))
+		defer cancel()
+	}
+
+	reqs := make([]jsonrpcRequest, len(calls))
+	for i, call := range calls {
+		id := fmt.Sprint(atomic.AddUint64(&c.idCnt, 1))
+		reqs[i] = newJSONRPCRequest(id, call.Method, call.Args)
+	}
+	raw, err := c.post(ctx, "batch", reqs)
+	if err != nil {
+		return err
+	}
+	responses, err := unmarshalResponses(raw)
+	if err != nil {
+		return errors.Wrap(err, "cannot unmarshal JSONRPC message")
+	}
+	byID := make(map[string]*jsonrpcResponse, len(responses))
+	for _, resp := range responses {
+		byID[resp.CorrelationID] = resp
+	}
+
+	c.mu.Lock()
+	recorder := c.recorder
+	c.mu.Unlock()
+
+	for i, req := range reqs {
+		resp, ok := byID[req.CorrelationID]
+		if !ok {
+			calls[i].Err = errors.Wrapf(ErrConnection, "no %s response in batch", req.Method)
+			continue
+		}
+		if recorder != nil {
+			if err := recorder.record(req.Method, req.Params, resp); err != nil {
+				log.Printf("cannot record %s response: %s", req.Method, err)
+			}
+		}
+		calls[i].Err = resp.decode(calls[i].Dest)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTendermintHTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("unexpected method %q", r.Method)
+		}
+		var req jsonrpcRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("cannot decode request: %s", err)
+			return
+		}
+
+		var resp string
+		switch req.Method {
+		case "abci_info":
+			resp = `{"jsonrpc": "2.0", "id": "` + req.CorrelationID + `", "result": {"response": {"last_block_height": "42"}}}`
+		case "commit":
+			resp = `{"jsonrpc": "2.0", "id": "` + req.CorrelationID + `", "error": {"code": -32603, "message": "Internal error", "data": "Height 99 must be less than or equal to the current blockchain height 42"}}`
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			resp = `<html>bad gateway</html>`
+		}
+		w.Write([]byte(resp))
+	}))
+	defer srv.Close()
+
+	tmc, err := ConnectTendermint(srv.URL)
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	defer tmc.Close()
+
+	ctx := context.Background()
+
+	info, err := AbciInfo(ctx, tmc)
+	if err != nil {
+		t.Fatalf("abci info: %s", err)
+	}
+	if info.LastBlockHeight != 42 {
+		t.Fatalf("unexpected height: %d", info.LastBlockHeight)
+	}
+
+	if _, err := Commit(ctx, tmc, 99); !ErrHeightNotAvailable.Is(err) {
+		t.Fatalf("want height not available error, got %q", err)
+	}
+
+	if _, err := FetchBlock(ctx, tmc, 1); !ErrConnection.Is(err) {
+		t.Fatalf("want connection error, got %q", err)
+	}
+}
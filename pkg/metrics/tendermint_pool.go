@@ -0,0 +1,362 @@
+package metrics
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/iov-one/block-metrics/pkg/errors"
+)
+
+// TendermintPool routes tendermint JSONRPC calls to one of several nodes. For
+// each node it tracks the latest height and the error rate. A call is made to
+// the healthiest node that has the requested height. If a call fails with a
+// transient error, it is repeated using the next best node.
+//
+// TendermintPool is safe for concurrent use.
+type TendermintPool struct {
+	stop chan struct{}
+	done chan struct{}
+
+	mu    sync.Mutex
+	nodes []*poolNode
+	// recorder is nil unless responses are recorded. It is passed to
+	// each node as soon as it is connected.
+	recorder *Recorder
+}
+
+var _ TendermintBatchRPC = (*TendermintPool)(nil)
+
+type poolNode struct {
+	uri string
+	// rpc is nil until the connection is established.
+	rpc TendermintRPC
+	// height is the latest height the node is known to have.
+	height int64
+	// errRate is the exponential moving average of the request failures,
+	// between zero and one.
+	errRate float64
+	lastErr error
+}
+
+const (
+	// poolCheckInterval is how often the height of each node is checked
+	// and the nodes that are not connected are dialed again.
+	poolCheckInterval = 5 * time.Second
+
+	// poolErrWeight is the weight of the most recent request result in
+	// the error rate.
+	poolErrWeight = 0.2
+
+	// poolMaxErrRate is the error rate above which a node is considered
+	// unhealthy and used only if no other node can be.
+	poolMaxErrRate = 0.5
+)
+
+// NewTendermintPool returns a client that spreads calls between nodes
+// available at given URIs. Any URI accepted by ConnectTendermint can be used.
+// Nodes that cannot be connected to yet are dialed again in the background.
+// At least one node must be available.
+func NewTendermintPool(uris []string) (*TendermintPool, error) {
+	if len(uris) == 0 {
+		return nil, errors.Wrap(ErrConnection, "no tendermint URI")
+	}
+	p := &TendermintPool{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	for _, uri := range uris {
+		p.nodes = append(p.nodes, &poolNode{uri: uri})
+	}
+
+	p.check()
+	var connected bool
+	for _, e := range p.Endpoints() {
+		connected = connected || e.Connected
+	}
+	if !connected {
+		close(p.stop)
+		return nil, errors.Wrap(ErrConnection, "no tendermint node available")
+	}
+
+	go p.checkLoop()
+	return p, nil
+}
+
+// Close releases all node connections.
+func (p *TendermintPool) Close() error {
+	close(p.stop)
+	<-p.done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
+	for _, n := range p.nodes {
+		if n.rpc == nil {
+			continue
+		}
+		if cerr := n.rpc.Close(); cerr != nil && err == nil {
+			err = errors.Wrapf(cerr, "close %s", n.uri)
+		}
+		n.rpc = nil
+	}
+	return err
+}
+
+// Record makes all nodes write the responses received to fixture files using
+// given recorder. Nodes that cannot record responses are skipped. Pass nil to
+// stop recording.
+func (p *TendermintPool) Record(r *Recorder) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.recorder = r
+	for _, n := range p.nodes {
+		if n.rpc != nil {
+			setRecorder(n.rpc, r)
+		}
+	}
+}
+
+// setRecorder sets the recorder of given client, if it supports recording.
+func setRecorder(rpc TendermintRPC, r *Recorder) {
+	if c, ok := rpc.(interface{ Record(*Recorder) }); ok {
+		c.Record(r)
+	}
+}
+
+// EndpointStatus describes the health of a single node.
+type EndpointStatus struct {
+	URI       string
+	Connected bool
+	Height    int64
+	ErrorRate float64
+	LastError error
+}
+
+// Endpoints returns the health of all nodes, in the order they were given.
+func (p *TendermintPool) Endpoints() []EndpointStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	res := make([]EndpointStatus, len(p.nodes))
+	for i, n := range p.nodes {
+		res[i] = EndpointStatus{
+			URI:       n.uri,
+			Connected: n.rpc != nil,
+			Height:    n.height,
+			ErrorRate: n.errRate,
+			LastError: n.lastErr,
+		}
+	}
+	return res
+}
+
+func (p *TendermintPool) checkLoop() {
+	defer close(p.done)
+
+	t := time.NewTicker(poolCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+			p.check()
+		}
+	}
+}
+
+// check connects all nodes that are not connected yet and updates the height
+// of all nodes.
+func (p *TendermintPool) check() {
+	var wg sync.WaitGroup
+	for _, n := range p.nodes {
+		wg.Add(1)
+		go func(n *poolNode) {
+			defer wg.Done()
+			p.checkNode(n)
+		}(n)
+	}
+	wg.Wait()
+}
+
+func (p *TendermintPool) checkNode(n *poolNode) {
+	p.mu.Lock()
+	rpc := n.rpc
+	p.mu.Unlock()
+
+	if rpc == nil {
+		c, err := ConnectTendermint(n.uri)
+		if err != nil {
+			p.record(n, 0, errors.Wrapf(ErrConnection, "connect: %s", err))
+			return
+		}
+		p.mu.Lock()
+		select {
+		case <-p.stop:
+			// Pool was closed while dialing.
+			p.mu.Unlock()
+			c.Close()
+			return
+		default:
+		}
+		n.rpc = c
+		if p.recorder != nil {
+			setRecorder(c, p.recorder)
+		}
+		p.mu.Unlock()
+		rpc = c
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), poolCheckInterval)
+	defer cancel()
+	info, err := AbciInfo(ctx, rpc)
+	if err != nil {
+		p.record(n, 0, err)
+		return
+	}
+	p.record(n, info.LastBlockHeight, nil)
+}
+
+// record updates the node health with the result of a request. Height is
+// updated if greater than the one known.
+func (p *TendermintPool) record(n *poolNode, height int64, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if height > n.height {
+		n.height = height
+	}
+	if err == nil {
+		n.errRate = (1 - poolErrWeight) * n.errRate
+		return
+	}
+	n.errRate = (1-poolErrWeight)*n.errRate + poolErrWeight
+	n.lastErr = err
+}
+
+// candidates returns all connected nodes, best suited to serve a request
+// for given height first. A height of zero means the latest one.
+func (p *TendermintPool) candidates(height int64) []*poolNode {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	nodes := make([]*poolNode, 0, len(p.nodes))
+	for _, n := range p.nodes {
+		if n.rpc != nil {
+			nodes = append(nodes, n)
+		}
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		if ah, bh := a.height >= height, b.height >= height; ah != bh {
+			return ah
+		}
+		if ak, bk := a.errRate < poolMaxErrRate, b.errRate < poolMaxErrRate; ak != bk {
+			return ak
+		}
+		if height == 0 && a.height != b.height {
+			// Latest state is best served by the node that is
+			// the least behind.
+			return a.height > b.height
+		}
+		return a.errRate < b.errRate
+	})
+	return nodes
+}
+
+// rpc returns the connection of the node.
+func (p *TendermintPool) rpc(n *poolNode) TendermintRPC {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return n.rpc
+}
+
+// DoContext makes a jsonrpc call using the best suited node. If the call
+// fails with a transient error, it is repeated using the next node.
+func (p *TendermintPool) DoContext(ctx context.Context, method string, dest interface{}, args ...interface{}) error {
+	height := requestHeight(method, args)
+	return p.do(ctx, height, func(rpc TendermintRPC) error {
+		return rpc.DoContext(ctx, method, dest, args...)
+	})
+}
+
+// DoBatch makes all calls using a single batch request to the best suited
+// node. If the batch fails as a whole with a transient error, it is repeated
+// using the next node. Calls are made one by one if the node does not support
+// batch requests.
+func (p *TendermintPool) DoBatch(ctx context.Context, calls []*BatchCall) error {
+	var height int64
+	for _, call := range calls {
+		if h := requestHeight(call.Method, call.Args); h > height {
+			height = h
+		}
+	}
+	return p.do(ctx, height, func(rpc TendermintRPC) error {
+		if b, ok := rpc.(TendermintBatchRPC); ok {
+			return b.DoBatch(ctx, calls)
+		}
+		for _, call := range calls {
+			call.Err = rpc.DoContext(ctx, call.Method, call.Dest, call.Args...)
+		}
+		return nil
+	})
+}
+
+// do calls fn with the best suited node first, until it succeeds or fails
+// with an error that is not transient.
+func (p *TendermintPool) do(ctx context.Context, height int64, fn func(TendermintRPC) error) error {
+	nodes := p.candidates(height)
+	if len(nodes) == 0 {
+		return errors.Wrap(ErrConnection, "no tendermint node available")
+	}
+
+	var err error
+	for i, n := range nodes {
+		rpc := p.rpc(n)
+		if rpc == nil {
+			// Pool was closed.
+			continue
+		}
+		err = fn(rpc)
+		if err == nil || !IsTransient(err) || ctx.Err() != nil {
+			// Only a node that responded has the height.
+			if err == nil {
+				p.record(n, height, nil)
+			}
+			return err
+		}
+		p.record(n, 0, err)
+		if i < len(nodes)-1 {
+			log.Printf("tendermint %s failed, trying another node: %s", n.uri, err)
+		}
+	}
+	return err
+}
+
+// requestHeight returns the height that given call is requesting or zero if
+// the call is not for a specific height.
+func requestHeight(method string, args []interface{}) int64 {
+	switch method {
+	case "commit", "validators", "block":
+	default:
+		return 0
+	}
+	if len(args) == 0 {
+		return 0
+	}
+	switch h := args[0].(type) {
+	case int64:
+		return h
+	case int:
+		return int64(h)
+	case sint64:
+		return int64(h)
+	}
+	return 0
+}
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/iov-one/block-metrics/pkg/tmtest"
+)
+
+func TestTendermintPool(t *testing.T) {
+	validators := []tmtest.Validator{{Address: []byte{0x01}, PubKey: []byte{0x11}}}
+
+	behind := tmtest.NewNode()
+	defer behind.Close()
+	ahead := tmtest.NewNode()
+	defer ahead.Close()
+	for i := 0; i < 5; i++ {
+		ahead.AddBlock(tmtest.Block{Validators: validators})
+		if i < 3 {
+			behind.AddBlock(tmtest.Block{Validators: validators})
+		}
+	}
+
+	var behindCalls, aheadCalls int32
+	behind.Hook(func(string, []string) *tmtest.RPCError {
+		atomic.AddInt32(&behindCalls, 1)
+		return nil
+	})
+	ahead.Hook(func(string, []string) *tmtest.RPCError {
+		atomic.AddInt32(&aheadCalls, 1)
+		return nil
+	})
+
+	pool, err := NewTendermintPool([]string{
+		behind.URL(),
+		ahead.HTTPURL(),
+		"ws://127.0.0.1:1/websocket",
+	})
+	if err != nil {
+		t.Fatalf("cannot create pool: %s", err)
+	}
+	defer pool.Close()
+
+	endpoints := pool.Endpoints()
+	if !endpoints[0].Connected || endpoints[0].Height != 3 {
+		t.Fatalf("unexpected first endpoint status: %#v", endpoints[0])
+	}
+	if !endpoints[1].Connected || endpoints[1].Height != 5 {
+		t.Fatalf("unexpected second endpoint status: %#v", endpoints[1])
+	}
+	if endpoints[2].Connected || endpoints[2].LastError == nil {
+		t.Fatalf("unexpected third endpoint status: %#v", endpoints[2])
+	}
+
+	ctx := context.Background()
+	atomic.StoreInt32(&behindCalls, 0)
+	atomic.StoreInt32(&aheadCalls, 0)
+
+	info, err := AbciInfo(ctx, pool)
+	if err != nil {
+		t.Fatalf("abci_info: %s", err)
+	}
+	if info.LastBlockHeight != 5 {
+		t.Fatalf("want the latest height from the node ahead, got %d", info.LastBlockHeight)
+	}
+	if c, err := Commit(ctx, pool, 5); err != nil || c.Height != 5 {
+		t.Fatalf("cannot get commit only the node ahead has: %v", err)
+	}
+	if n := atomic.LoadInt32(&behindCalls); n != 0 {
+		t.Fatalf("want no calls to the node behind, got %d", n)
+	}
+
+	// Node that disappeared must be failed over.
+	ahead.Close()
+	if info, err := AbciInfo(ctx, pool); err != nil || info.LastBlockHeight != 3 {
+		t.Fatalf("cannot get abci_info after failover: %v", err)
+	}
+	if n := atomic.LoadInt32(&behindCalls); n != 1 {
+		t.Fatalf("want one call to the node behind, got %d", n)
+	}
+	if status := pool.Endpoints()[1]; status.ErrorRate == 0 || !ErrConnection.Is(status.LastError) {
+		t.Fatalf("failure of the node ahead not recorded: %#v", status)
+	}
+}
+
+func TestTendermintPoolRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatalf("cannot create fixture directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	validators := []tmtest.Validator{{Address: []byte{0x01}, PubKey: []byte{0x11}}}
+	behind := tmtest.NewNode()
+	defer behind.Close()
+	ahead := tmtest.NewNode()
+	defer ahead.Close()
+	for i := 0; i < 5; i++ {
+		ahead.AddBlock(tmtest.Block{Validators: validators})
+		if i < 3 {
+			behind.AddBlock(tmtest.Block{Validators: validators})
+		}
+	}
+
+	pool, err := NewTendermintPool([]string{behind.URL(), ahead.HTTPURL()})
+	if err != nil {
+		t.Fatalf("cannot create pool: %s", err)
+	}
+	defer pool.Close()
+	rec, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatalf("cannot create recorder: %s", err)
+	}
+	pool.Record(rec)
+
+	// Only the node ahead has the commit. Once it is gone, the node
+	// behind serves the info.
+	ctx := context.Background()
+	if _, err := Commit(ctx, pool, 5); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	ahead.Close()
+	if _, err := AbciInfo(ctx, pool); err != nil {
+		t.Fatalf("abci_info: %s", err)
+	}
+
+	for _, name := range []string{fixtureName("commit", []string{"5"}), fixtureName("abci_info", nil)} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("fixture %s not recorded: %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,634 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/iov-one/block-metrics/pkg/errors"
+	"github.com/iov-one/block-metrics/pkg/tmtest"
+	bnsd "github.com/iov-one/weave/cmd/bnsd/app"
+	"github.com/iov-one/weave/coin"
+	"github.com/iov-one/weave/x/cash"
+)
+
+func TestJSONRPCErrorKind(t *testing.T) {
+	cases := map[string]struct {
+		err       jsonrpcError
+		wantErr   *errors.Error
+		transient bool
+	}{
+		"height not available": {
+			err: jsonrpcError{
+				Code:    -32603,
+				Message: "Internal error",
+				Data:    "Height 100 must be less than or equal to the current blockchain height 50",
+			},
+			wantErr:   ErrHeightNotAvailable,
+			transient: true,
+		},
+		"method not found": {
+			err: jsonrpcError{
+				Code:    -32601,
+				Message: "Method not found",
+			},
+			wantErr: ErrMethodNotFound,
+		},
+		"invalid params": {
+			err: jsonrpcError{
+				Code:    -32602,
+				Message: "Invalid params",
+				Data:    "error converting json params to arguments",
+			},
+			wantErr: ErrInvalidParams,
+		},
+		"timeout": {
+			err: jsonrpcError{
+				Code:    -32603,
+				Message: "Internal error",
+				Data:    "timed out waiting for tx to be included in a block",
+			},
+			wantErr:   ErrTimeout,
+			transient: true,
+		},
+		"page out of range": {
+			err: jsonrpcError{
+				Code:    -32603,
+				Message: "Internal error",
+				Data:    "page should be within [1, 2] range, given 3",
+			},
+			wantErr: ErrPageOutOfRange,
+		},
+		"internal": {
+			err: jsonrpcError{
+				Code:    -32603,
+				Message: "Internal error",
+				Data:    "something went wrong",
+			},
+			wantErr:   ErrInternal,
+			transient: true,
+		},
+		"unknown": {
+			err: jsonrpcError{
+				Code:    -1,
+				Message: "Unknown",
+			},
+			wantErr: ErrFailedResponse,
+		},
+	}
+
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			err := tc.err.Err()
+			if !tc.wantErr.Is(err) {
+				t.Fatalf("want %q error, got %q", tc.wantErr, err)
+			}
+			if !ErrFailedResponse.Is(err) {
+				t.Fatalf("want failed response error, got %q", err)
+			}
+			if got := IsTransient(err); got != tc.transient {
+				t.Fatalf("want transient %v, got %v", tc.transient, got)
+			}
+		})
+	}
+}
+
+func TestTendermintClientReconnect(t *testing.T) {
+	var connections int32
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Logf("cannot upgrade: %s", err)
+			return
+		}
+		defer conn.Close()
+
+		// First connection is dropped as soon as a request is
+		// received, without responding.
+		drop := atomic.AddInt32(&connections, 1) == 1
+
+		for {
+			var req jsonrpcRequest
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			if drop {
+				return
+			}
+			resp := map[string]interface{}{
+				"jsonrpc": "2.0",
+				"id":      req.CorrelationID,
+				"result":  map[string]interface{}{"response": map[string]string{"last_block_height": "7"}},
+			}
+			if err := conn.WriteJSON(resp); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	tmc, err := DialTendermint("ws" + strings.TrimPrefix(srv.URL, "http"))
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer tmc.Close()
+
+	if _, err := AbciInfo(context.Background(), tmc); !ErrConnection.Is(err) {
+		t.Fatalf("want connection error, got %q", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := AbciInfo(context.Background(), tmc)
+		if err == nil {
+			if info.LastBlockHeight != 7 {
+				t.Fatalf("unexpected height: %d", info.LastBlockHeight)
+			}
+			break
+		}
+		if !ErrConnection.Is(err) {
+			t.Fatalf("want connection error, got %q", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("client did not reconnect: %s", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&connections); n != 2 {
+		t.Fatalf("want 2 connections, got %d", n)
+	}
+}
+
+func TestTendermintClientRestoreSubscriptionDropped(t *testing.T) {
+	cases := map[string]struct {
+		// interrupt is called while the subscription is being
+		// restored.
+		interrupt func(*TendermintClient) error
+		// closesClient is true if interrupt closes the client.
+		closesClient bool
+	}{
+		"unsubscribed": {
+			interrupt: func(tmc *TendermintClient) error {
+				err := tmc.Unsubscribe(context.Background(), "tm.event='NewBlock'")
+				if !ErrConnection.Is(err) {
+					return errors.Wrap(err, "unexpected unsubscribe result")
+				}
+				return nil
+			},
+		},
+		"client closed": {
+			interrupt: func(tmc *TendermintClient) error {
+				return tmc.Close()
+			},
+			closesClient: true,
+		},
+	}
+
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			var connections int32
+			restoring := make(chan struct{})
+			upgrader := websocket.Upgrader{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					t.Logf("cannot upgrade: %s", err)
+					return
+				}
+				defer conn.Close()
+
+				// First connection accepts the subscription and
+				// is dropped. Second connection never responds to
+				// the restored subscription and is dropped once
+				// another request is received. Any following
+				// connection is never responded to.
+				n := atomic.AddInt32(&connections, 1)
+
+				var req jsonrpcRequest
+				if err := conn.ReadJSON(&req); err != nil {
+					return
+				}
+				switch n {
+				case 1:
+				case 2:
+					close(restoring)
+					conn.ReadJSON(&req)
+					return
+				default:
+					for conn.ReadJSON(&req) == nil {
+					}
+					return
+				}
+				resp := map[string]interface{}{
+					"jsonrpc": "2.0",
+					"id":      req.CorrelationID,
+					"result":  map[string]interface{}{},
+				}
+				conn.WriteJSON(resp)
+			}))
+			defer srv.Close()
+
+			tmc, err := DialTendermint("ws" + strings.TrimPrefix(srv.URL, "http"))
+			if err != nil {
+				t.Fatalf("cannot dial: %s", err)
+			}
+			if !tc.closesClient {
+				defer tmc.Close()
+			}
+
+			events, err := tmc.Subscribe(context.Background(), "tm.event='NewBlock'")
+			if err != nil {
+				t.Fatalf("cannot subscribe: %s", err)
+			}
+
+			select {
+			case <-restoring:
+			case <-time.After(5 * time.Second):
+				t.Fatal("subscription not restored")
+			}
+			if err := tc.interrupt(tmc); err != nil {
+				t.Fatalf("cannot interrupt: %s", err)
+			}
+
+			select {
+			case _, ok := <-events:
+				if ok {
+					t.Fatal("unexpected event")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("events channel not closed")
+			}
+			// Failed restore must not close the events channel
+			// again.
+			time.Sleep(50 * time.Millisecond)
+		})
+	}
+}
+
+func TestTendermintClientDoContextTimeout(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Logf("cannot upgrade: %s", err)
+			return
+		}
+		defer conn.Close()
+
+		// Never respond.
+		for {
+			var req jsonrpcRequest
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	tmc, err := DialTendermint("ws" + strings.TrimPrefix(srv.URL, "http"))
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer tmc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := AbciInfo(ctx, tmc); !ErrTimeout.Is(err) {
+		t.Fatalf("want timeout error, got %q", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := Commit(ctx, tmc, 1); err == nil || ErrTimeout.Is(err) {
+		t.Fatalf("want cancellation error, got %q", err)
+	}
+
+	tmc.mu.Lock()
+	pending := len(tmc.resp)
+	tmc.mu.Unlock()
+	if pending != 0 {
+		t.Fatalf("want no pending requests, got %d", pending)
+	}
+}
+
+func TestDoBatch(t *testing.T) {
+	node := tmtest.NewNode()
+	defer node.Close()
+	node.AddBlock(tmtest.Block{
+		Validators: []tmtest.Validator{{Address: []byte{0x01}, PubKey: []byte{0x11}}},
+	})
+	node.AddBlock(tmtest.Block{})
+
+	ws, err := DialTendermint(node.URL())
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer ws.Close()
+
+	clients := map[string]TendermintBatchRPC{
+		"websocket": ws,
+		"http":      NewTendermintHTTPClient(node.HTTPURL()),
+	}
+	for name, c := range clients {
+		t.Run(name, func(t *testing.T) {
+			var commits [3]commitPayload
+			calls := []*BatchCall{
+				{Method: "commit", Args: []interface{}{2}, Dest: &commits[0]},
+				{Method: "commit", Args: []interface{}{3}, Dest: &commits[1]},
+				{Method: "commit", Args: []interface{}{1}, Dest: &commits[2]},
+			}
+			if err := c.DoBatch(context.Background(), calls); err != nil {
+				t.Fatalf("batch: %s", err)
+			}
+
+			if calls[0].Err != nil || commits[0].commit().Height != 2 {
+				t.Fatalf("unexpected first call result: %v, height %d", calls[0].Err, commits[0].commit().Height)
+			}
+			if !ErrHeightNotAvailable.Is(calls[1].Err) {
+				t.Fatalf("want height not available error, got %v", calls[1].Err)
+			}
+			if calls[2].Err != nil || commits[2].commit().Height != 1 {
+				t.Fatalf("unexpected last call result: %v, height %d", calls[2].Err, commits[2].commit().Height)
+			}
+		})
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	node := tmtest.NewNode()
+	defer node.Close()
+
+	tmc, err := DialTendermint(node.URL())
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer tmc.Close()
+
+	ctx := context.Background()
+	blocks, err := tmc.SubscribeWith(ctx, "tm.event='NewBlock'", SubscriptionConfig{Buffer: 1, Overflow: DropOldest})
+	if err != nil {
+		t.Fatalf("cannot subscribe to blocks: %s", err)
+	}
+	txs, err := tmc.SubscribeWith(ctx, "tm.event='Tx'", SubscriptionConfig{Buffer: 1, Overflow: CloseOnOverflow})
+	if err != nil {
+		t.Fatalf("cannot subscribe to transactions: %s", err)
+	}
+	updates, err := tmc.Subscribe(ctx, "tm.event='ValidatorSetUpdates'")
+	if err != nil {
+		t.Fatalf("cannot subscribe to validator updates: %s", err)
+	}
+	// Events are delivered in subscription order, so once a header is
+	// received, all other events for that block were processed.
+	headers, err := tmc.Subscribe(ctx, "tm.event='NewBlockHeader'")
+	if err != nil {
+		t.Fatalf("cannot subscribe to headers: %s", err)
+	}
+
+	alice := tmtest.Validator{Address: []byte{0x01}, PubKey: []byte{0x11}, VotingPower: 10}
+	bob := tmtest.Validator{Address: []byte{0x02}, PubKey: []byte{0x22}, VotingPower: 5}
+	send := &bnsd.Tx{
+		Sum: &bnsd.Tx_CashSendMsg{CashSendMsg: &cash.SendMsg{
+			Source:      []byte{0x01},
+			Destination: []byte{0x02},
+			Amount:      coin.NewCoinp(1, 0, "IOV"),
+		}},
+	}
+	node.AddBlock(tmtest.Block{Validators: []tmtest.Validator{alice}, Txs: []*bnsd.Tx{send, send}})
+	node.AddBlock(tmtest.Block{Validators: []tmtest.Validator{bob}})
+	node.AddBlock(tmtest.Block{})
+
+	for want := int64(1); want <= 3; want++ {
+		select {
+		case ev := <-headers:
+			if ev.Err != nil || ev.NewBlockHeader == nil || ev.NewBlockHeader.Height != want {
+				t.Fatalf("unexpected header event: %#v", ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no header event for height %d", want)
+		}
+	}
+
+	// Only the latest block is kept.
+	if ev := <-blocks; ev.NewBlock == nil || ev.NewBlock.Height != 3 {
+		t.Fatalf("unexpected block event: %#v", ev)
+	}
+	select {
+	case ev := <-blocks:
+		t.Fatalf("unexpected block event: %#v", ev)
+	default:
+	}
+
+	// Second transaction did not fit into the buffer.
+	if ev := <-txs; ev.Tx == nil || ev.Tx.Height != 1 || ev.Tx.Index != 0 || !reflect.DeepEqual(ev.Tx.Tx, send) {
+		t.Fatalf("unexpected tx event: %#v", ev)
+	}
+	if ev, ok := <-txs; ok {
+		t.Fatalf("want transactions subscription closed, got %#v", ev)
+	}
+
+	wantUpdates := [][]*ValidatorUpdate{
+		{{Address: alice.Address, PubKey: alice.PubKey, VotingPower: 10}},
+		{
+			{Address: bob.Address, PubKey: bob.PubKey, VotingPower: 5},
+			{Address: alice.Address, PubKey: alice.PubKey, VotingPower: 0},
+		},
+	}
+	for _, want := range wantUpdates {
+		ev := <-updates
+		if !reflect.DeepEqual(ev.ValidatorSetUpdates, want) {
+			t.Logf(" got %#v", ev.ValidatorSetUpdates)
+			t.Logf("want %#v", want)
+			t.Fatal("unexpected validator set updates")
+		}
+	}
+
+	if err := tmc.Unsubscribe(ctx, "tm.event='NewBlockHeader'"); err != nil {
+		t.Fatalf("cannot unsubscribe: %s", err)
+	}
+	if _, ok := <-headers; ok {
+		t.Fatal("want headers subscription closed")
+	}
+	if err := tmc.Unsubscribe(ctx, "tm.event='NewBlockHeader'"); !ErrNotFound.Is(err) {
+		t.Fatalf("want not found error, got %v", err)
+	}
+	// Tendermint must be notified so that subscribing again is possible.
+	if _, err := tmc.Subscribe(ctx, "tm.event='NewBlockHeader'"); err != nil {
+		t.Fatalf("cannot subscribe again: %s", err)
+	}
+}
+
+func TestValidators(t *testing.T) {
+	node := tmtest.NewNode()
+	defer node.Close()
+
+	var validators []tmtest.Validator
+	for i := 0; i < 250; i++ {
+		validators = append(validators, tmtest.Validator{
+			Address:     []byte{byte(i >> 8), byte(i)},
+			PubKey:      []byte{0xFF, byte(i >> 8), byte(i)},
+			VotingPower: int64(i + 1),
+		})
+	}
+	node.AddBlock(tmtest.Block{Validators: validators})
+	node.AddBlock(tmtest.Block{Validators: validators[:5]})
+
+	c := NewTendermintHTTPClient(node.HTTPURL())
+	ctx := context.Background()
+
+	got, err := Validators(ctx, c, 1)
+	if err != nil {
+		t.Fatalf("cannot get validators: %s", err)
+	}
+	if len(got) != len(validators) {
+		t.Fatalf("want %d validators, got %d", len(validators), len(got))
+	}
+	for i, v := range validators {
+		want := &TendermintValidator{Address: v.Address, PubKey: v.PubKey, VotingPower: v.VotingPower}
+		if !reflect.DeepEqual(got[i], want) {
+			t.Fatalf("validator %d: want %#v, got %#v", i, want, got[i])
+		}
+	}
+
+	// Nodes before tendermint 0.32 do not accept pagination params.
+	node.Hook(func(method string, params []string) *tmtest.RPCError {
+		if method == "validators" && len(params) > 1 {
+			return &tmtest.RPCError{Code: -32602, Message: "Invalid params", Data: "expected 1 parameters"}
+		}
+		return nil
+	})
+	got, err = Validators(ctx, c, 2)
+	if err != nil {
+		t.Fatalf("cannot get validators without pagination: %s", err)
+	}
+	if len(got) != 5 {
+		t.Fatalf("want 5 validators, got %d", len(got))
+	}
+}
+
+func TestValidatorsFullLastPage(t *testing.T) {
+	cases := map[string]struct {
+		omitTotal bool
+		wantPages []string
+	}{
+		"total reported": {
+			wantPages: []string{"1", "2"},
+		},
+		// Tendermint 0.32 does not report the total, so the page
+		// following the full last one is requested as well.
+		"total not reported": {
+			omitTotal: true,
+			wantPages: []string{"1", "2", "3"},
+		},
+	}
+
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			node := tmtest.NewNode()
+			defer node.Close()
+
+			var validators []tmtest.Validator
+			for i := 0; i < 2*validatorsPerPage; i++ {
+				validators = append(validators, tmtest.Validator{
+					Address: []byte{byte(i >> 8), byte(i)},
+					PubKey:  []byte{0xFF, byte(i >> 8), byte(i)},
+				})
+			}
+			node.AddBlock(tmtest.Block{Validators: validators})
+			node.OmitValidatorsTotal(tc.omitTotal)
+
+			var (
+				mu    sync.Mutex
+				pages []string
+			)
+			node.Hook(func(method string, params []string) *tmtest.RPCError {
+				if method == "validators" {
+					mu.Lock()
+					pages = append(pages, params[1])
+					mu.Unlock()
+				}
+				return nil
+			})
+
+			// Page out of range is not a transient error and must
+			// not be repeated using another node.
+			pool, err := NewTendermintPool([]string{node.HTTPURL(), node.URL()})
+			if err != nil {
+				t.Fatalf("cannot create pool: %s", err)
+			}
+			defer pool.Close()
+
+			got, err := Validators(context.Background(), pool, 1)
+			if err != nil {
+				t.Fatalf("cannot get validators: %s", err)
+			}
+			if len(got) != len(validators) {
+				t.Fatalf("want %d validators, got %d", len(validators), len(got))
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(pages, tc.wantPages) {
+				t.Fatalf("want pages %v requested, got %v", tc.wantPages, pages)
+			}
+		})
+	}
+}
+
+func TestCommitFormats(t *testing.T) {
+	node := tmtest.NewNode()
+	defer node.Close()
+	node.AddBlock(tmtest.Block{
+		Validators: []tmtest.Validator{
+			{Address: []byte{0x01}, PubKey: []byte{0x11}, VotingPower: 1},
+			{Address: []byte{0x02}, PubKey: []byte{0x22}, VotingPower: 1},
+			{Address: []byte{0x03}, PubKey: []byte{0x33}, VotingPower: 1},
+		},
+		Signers:   [][]byte{{0x01}},
+		NilVoters: [][]byte{{0x03}},
+	})
+
+	cases := map[string]struct {
+		format           tmtest.CommitFormat
+		wantParticipants [][]byte
+		wantNilVotes     [][]byte
+	}{
+		"precommits": {
+			format:           tmtest.PrecommitsFormat,
+			wantParticipants: [][]byte{{0x01}},
+		},
+		"signatures": {
+			format:           tmtest.SignaturesFormat,
+			wantParticipants: [][]byte{{0x01}},
+			wantNilVotes:     [][]byte{{0x03}},
+		},
+	}
+
+	c := NewTendermintHTTPClient(node.HTTPURL())
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			node.SetCommitFormat(tc.format)
+			commit, err := Commit(context.Background(), c, 1)
+			if err != nil {
+				t.Fatalf("commit: %s", err)
+			}
+			if !bytes.Equal(commit.Hash, node.BlockHash(1)) {
+				t.Fatalf("unexpected hash %X", commit.Hash)
+			}
+			if !reflect.DeepEqual(commit.ParticipantAddresses, tc.wantParticipants) {
+				t.Fatalf("want participants %X, got %X", tc.wantParticipants, commit.ParticipantAddresses)
+			}
+			if !reflect.DeepEqual(commit.NilVoteAddresses, tc.wantNilVotes) {
+				t.Fatalf("want nil votes %X, got %X", tc.wantNilVotes, commit.NilVoteAddresses)
+			}
+		})
+	}
+}
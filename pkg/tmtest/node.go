@@ -0,0 +1,776 @@
+// Package tmtest provides an in-process fake of a tendermint node that can be
+// used to test clients of the tendermint JSONRPC API without running a real
+// node.
+package tmtest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	bnsd "github.com/iov-one/weave/cmd/bnsd/app"
+)
+
+// Node serves an in-memory chain using the tendermint JSONRPC API. Both
+// websocket and plain HTTP POST requests are supported, including batch
+// requests. Supported methods are abci_info, commit, validators, block,
+// subscribe and unsubscribe. Subscriptions are available for NewBlock,
+// NewBlockHeader, Tx and ValidatorSetUpdates events.
+//
+// Node is safe for concurrent use.
+type Node struct {
+	srv *httptest.Server
+
+	mu     sync.Mutex
+	blocks []*block
+	subs   []*subscriber
+	// hook is called for each request before it is served.
+	hook         func(method string, params []string) *RPCError
+	commitFormat CommitFormat
+	omitTotal    bool
+}
+
+// CommitFormat is the format of the commit call result, which changed between
+// tendermint versions.
+type CommitFormat int
+
+const (
+	// PrecommitsFormat is used by tendermint 0.32 and older. Nil votes are
+	// not included.
+	PrecommitsFormat CommitFormat = iota
+	// SignaturesFormat is used by tendermint 0.33 and newer.
+	SignaturesFormat
+)
+
+// SetCommitFormat changes the format of the commit call result. Precommits
+// format is used by default.
+func (n *Node) SetCommitFormat(f CommitFormat) {
+	n.mu.Lock()
+	n.commitFormat = f
+	n.mu.Unlock()
+}
+
+// OmitValidatorsTotal changes the validators call result to not report the
+// total number of validators, as tendermint 0.32 and older do. Total is
+// reported by default.
+func (n *Node) OmitValidatorsTotal(omit bool) {
+	n.mu.Lock()
+	n.omitTotal = omit
+	n.mu.Unlock()
+}
+
+// Block describes a block that is appended to the chain.
+type Block struct {
+	// Time is the block creation time. Current time is used if zero.
+	Time time.Time
+	// Validators is the validator set for the block. The validator set of
+	// the previous block is used if nil.
+	Validators []Validator
+	// Proposer is the address of the block proposer. First validator is
+	// used if nil.
+	Proposer []byte
+	// Signers are the addresses of validators that precommitted this
+	// block. All validators are signers if nil.
+	Signers [][]byte
+	// NilVoters are the addresses of validators that precommitted nil.
+	// They are visible only in the signatures commit format.
+	NilVoters [][]byte
+	// Txs are the transactions included in the block.
+	Txs []*bnsd.Tx
+}
+
+// Validator is a member of a validator set.
+type Validator struct {
+	Address     []byte
+	PubKey      []byte
+	VotingPower int64
+}
+
+// RPCError is a JSONRPC error returned by the node.
+type RPCError struct {
+	Code    int64  `json:"code"`
+	Message string `json:"message"`
+	Data    string `json:"data,omitempty"`
+}
+
+type block struct {
+	Block
+	height         int64
+	hash           []byte
+	validatorsHash []byte
+	rawTxs         [][]byte
+}
+
+type subscriber struct {
+	wmu   *sync.Mutex
+	conn  *websocket.Conn
+	id    string
+	query string
+	// event is the type of events delivered.
+	event string
+}
+
+// NewNode starts a node serving an empty chain. Call Close to release all
+// resources.
+func NewNode() *Node {
+	n := &Node{}
+	n.srv = httptest.NewServer(http.HandlerFunc(n.serveHTTP))
+	return n
+}
+
+// Close shuts down the node.
+func (n *Node) Close() {
+	n.srv.CloseClientConnections()
+	n.srv.Close()
+}
+
+// URL returns the address of the websocket endpoint.
+func (n *Node) URL() string {
+	return "ws" + strings.TrimPrefix(n.srv.URL, "http") + "/websocket"
+}
+
+// HTTPURL returns the address of the plain HTTP endpoint.
+func (n *Node) HTTPURL() string {
+	return n.srv.URL
+}
+
+// Hook registers a function that is called before each request is served.
+// If it returns an error, the request fails with that error. Use it to
+// script failures. Pass nil to remove the hook.
+func (n *Node) Hook(fn func(method string, params []string) *RPCError) {
+	n.mu.Lock()
+	n.hook = fn
+	n.mu.Unlock()
+}
+
+// AddBlock appends a block to the chain and returns its height. All NewBlock
+// subscribers are notified.
+func (n *Node) AddBlock(b Block) int64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var prev *block
+	if len(n.blocks) > 0 {
+		prev = n.blocks[len(n.blocks)-1]
+	}
+
+	if b.Time.IsZero() {
+		b.Time = time.Now().UTC()
+	}
+	if b.Validators == nil {
+		if prev == nil {
+			panic("first block must declare validators")
+		}
+		b.Validators = prev.Validators
+	}
+	if b.Proposer == nil {
+		b.Proposer = b.Validators[0].Address
+	}
+	if b.Signers == nil {
+		for _, v := range b.Validators {
+			b.Signers = append(b.Signers, v.Address)
+		}
+	}
+
+	blk := &block{
+		Block:          b,
+		height:         int64(len(n.blocks) + 1),
+		validatorsHash: validatorsHash(b.Validators),
+	}
+	for _, tx := range b.Txs {
+		raw, err := tx.Marshal()
+		if err != nil {
+			panic(fmt.Sprintf("cannot marshal transaction: %s", err))
+		}
+		blk.rawTxs = append(blk.rawTxs, raw)
+	}
+
+	// Hash links to the previous block so that two chains that diverged
+	// once never agree again.
+	h := sha256.New()
+	if prev != nil {
+		h.Write(prev.hash)
+	}
+	binary.Write(h, binary.BigEndian, blk.height)
+	h.Write([]byte(b.Time.Format(time.RFC3339Nano)))
+	for _, raw := range blk.rawTxs {
+		h.Write(raw)
+	}
+	blk.hash = h.Sum(nil)
+
+	n.blocks = append(n.blocks, blk)
+
+	for _, s := range n.subs {
+		s.notify(blk, prev)
+	}
+	return blk.height
+}
+
+// Truncate removes all blocks above given height. Use it together with
+// AddBlock to simulate a chain that diverged.
+func (n *Node) Truncate(height int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if height < int64(len(n.blocks)) {
+		n.blocks = n.blocks[:height]
+	}
+}
+
+// Height returns the height of the last block.
+func (n *Node) Height() int64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return int64(len(n.blocks))
+}
+
+// BlockHash returns the hash of the block at given height.
+func (n *Node) BlockHash(height int64) []byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.blocks[height-1].hash
+}
+
+func validatorsHash(validators []Validator) []byte {
+	h := sha256.New()
+	for _, v := range validators {
+		h.Write(v.Address)
+		h.Write(v.PubKey)
+		binary.Write(h, binary.BigEndian, v.VotingPower)
+	}
+	return h.Sum(nil)
+}
+
+type request struct {
+	ID     string   `json:"id"`
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+}
+
+type response struct {
+	ProtocolVersion string      `json:"jsonrpc"`
+	ID              string      `json:"id"`
+	Result          interface{} `json:"result,omitempty"`
+	Error           *RPCError   `json:"error,omitempty"`
+}
+
+func (n *Node) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		n.serveWebsocket(w, r)
+		return
+	}
+
+	raw, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reqs, isBatch, err := decodeRequests(raw)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	responses := make([]response, len(reqs))
+	for i, req := range reqs {
+		if req.Method == "subscribe" || req.Method == "unsubscribe" {
+			responses[i] = newResponse(req.ID, nil, &RPCError{Code: -32601, Message: "Method not found"})
+			continue
+		}
+		result, rpcErr := n.serve(req)
+		responses[i] = newResponse(req.ID, result, rpcErr)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if isBatch {
+		json.NewEncoder(w).Encode(responses)
+	} else {
+		json.NewEncoder(w).Encode(responses[0])
+	}
+}
+
+// decodeRequests decodes a single request or a batch of requests.
+func decodeRequests(raw []byte) (reqs []request, isBatch bool, err error) {
+	if b := bytes.TrimSpace(raw); len(b) > 0 && b[0] == '[' {
+		if err := json.Unmarshal(b, &reqs); err != nil {
+			return nil, true, err
+		}
+		if len(reqs) == 0 {
+			return nil, true, errors.New("empty batch")
+		}
+		return reqs, true, nil
+	}
+	var req request
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return nil, false, err
+	}
+	return []request{req}, false, nil
+}
+
+func newResponse(id string, result interface{}, rpcErr *RPCError) response {
+	return response{
+		ProtocolVersion: "2.0",
+		ID:              id,
+		Result:          result,
+		Error:           rpcErr,
+	}
+}
+
+var upgrader = websocket.Upgrader{}
+
+func (n *Node) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var wmu sync.Mutex
+	defer n.unsubscribeAll(conn)
+
+	for {
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		reqs, isBatch, err := decodeRequests(raw)
+		if err != nil {
+			continue
+		}
+
+		responses := make([]response, len(reqs))
+		for i, req := range reqs {
+			var (
+				result interface{}
+				rpcErr *RPCError
+			)
+			switch req.Method {
+			case "subscribe":
+				result, rpcErr = n.subscribe(&wmu, conn, req)
+			case "unsubscribe":
+				result, rpcErr = n.unsubscribe(conn, req)
+			default:
+				result, rpcErr = n.serve(req)
+			}
+			responses[i] = newResponse(req.ID, result, rpcErr)
+		}
+
+		wmu.Lock()
+		if isBatch {
+			err = conn.WriteJSON(responses)
+		} else {
+			err = conn.WriteJSON(responses[0])
+		}
+		wmu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (n *Node) subscribe(wmu *sync.Mutex, conn *websocket.Conn, req request) (interface{}, *RPCError) {
+	if len(req.Params) != 1 {
+		return nil, &RPCError{Code: -32602, Message: "Invalid params", Data: "query required"}
+	}
+	if rpcErr := n.callHook(req); rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	event, ok := eventTypes[strings.Replace(req.Params[0], " ", "", -1)]
+	if !ok {
+		return nil, &RPCError{Code: -32603, Message: "Internal error", Data: "unsupported query " + req.Params[0]}
+	}
+	for _, s := range n.subs {
+		if s.conn == conn && s.query == req.Params[0] {
+			return nil, &RPCError{Code: -32603, Message: "Internal error", Data: "already subscribed"}
+		}
+	}
+	n.subs = append(n.subs, &subscriber{
+		wmu:   wmu,
+		conn:  conn,
+		id:    req.ID,
+		query: req.Params[0],
+		event: event,
+	})
+	return struct{}{}, nil
+}
+
+// eventTypes maps supported queries to the type of events delivered.
+var eventTypes = map[string]string{
+	"tm.event='NewBlock'":            "NewBlock",
+	"tm.event='NewBlockHeader'":      "NewBlockHeader",
+	"tm.event='Tx'":                  "Tx",
+	"tm.event='ValidatorSetUpdates'": "ValidatorSetUpdates",
+}
+
+func (n *Node) unsubscribe(conn *websocket.Conn, req request) (interface{}, *RPCError) {
+	if len(req.Params) != 1 {
+		return nil, &RPCError{Code: -32602, Message: "Invalid params", Data: "query required"}
+	}
+	if rpcErr := n.callHook(req); rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for i, s := range n.subs {
+		if s.conn == conn && s.query == req.Params[0] {
+			n.subs = append(n.subs[:i], n.subs[i+1:]...)
+			return struct{}{}, nil
+		}
+	}
+	return nil, &RPCError{Code: -32603, Message: "Internal error", Data: "subscription not found"}
+}
+
+func (n *Node) unsubscribeAll(conn *websocket.Conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	subs := n.subs[:0]
+	for _, s := range n.subs {
+		if s.conn != conn {
+			subs = append(subs, s)
+		}
+	}
+	n.subs = subs
+}
+
+// notify sends all events of the subscribed type that were caused by
+// appending block b to the chain ending with prev.
+func (s *subscriber) notify(b, prev *block) {
+	switch s.event {
+	case "NewBlock":
+		s.send("NewBlock", map[string]interface{}{
+			"block": blockPayload(b),
+		})
+	case "NewBlockHeader":
+		s.send("NewBlockHeader", map[string]interface{}{
+			"header": headerPayload(b),
+		})
+	case "Tx":
+		for i, raw := range b.rawTxs {
+			s.send("Tx", map[string]interface{}{
+				"TxResult": map[string]interface{}{
+					"height": strconv.FormatInt(b.height, 10),
+					"index":  i,
+					"tx":     raw,
+					"result": map[string]interface{}{},
+				},
+			})
+		}
+	case "ValidatorSetUpdates":
+		if updates := validatorUpdates(prev, b); len(updates) > 0 {
+			s.send("ValidatorSetUpdates", map[string]interface{}{
+				"validator_updates": updates,
+			})
+		}
+	}
+}
+
+func (s *subscriber) send(eventType string, value interface{}) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.conn.WriteJSON(response{
+		ProtocolVersion: "2.0",
+		ID:              s.id + "#event",
+		Result: map[string]interface{}{
+			"query": s.query,
+			"data": map[string]interface{}{
+				"type":  "tendermint/event/" + eventType,
+				"value": value,
+			},
+		},
+	})
+}
+
+// validatorUpdates returns the changes of the validator set between two
+// blocks. Removed validators are reported with zero voting power.
+func validatorUpdates(prev, b *block) []interface{} {
+	var before []Validator
+	if prev != nil {
+		before = prev.Validators
+	}
+
+	var updates []interface{}
+	for _, v := range b.Validators {
+		if old, ok := findValidator(before, v.Address); !ok || old.VotingPower != v.VotingPower {
+			updates = append(updates, validatorPayload(v))
+		}
+	}
+	for _, v := range before {
+		if _, ok := findValidator(b.Validators, v.Address); !ok {
+			v.VotingPower = 0
+			updates = append(updates, validatorPayload(v))
+		}
+	}
+	return updates
+}
+
+func findValidator(validators []Validator, address []byte) (Validator, bool) {
+	for _, v := range validators {
+		if bytes.Equal(v.Address, address) {
+			return v, true
+		}
+	}
+	return Validator{}, false
+}
+
+func (n *Node) callHook(req request) *RPCError {
+	n.mu.Lock()
+	hook := n.hook
+	n.mu.Unlock()
+
+	if hook == nil {
+		return nil
+	}
+	return hook(req.Method, req.Params)
+}
+
+func (n *Node) serve(req request) (interface{}, *RPCError) {
+	if rpcErr := n.callHook(req); rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch req.Method {
+	case "abci_info":
+		return map[string]interface{}{
+			"response": map[string]interface{}{
+				"last_block_height": strconv.Itoa(len(n.blocks)),
+			},
+		}, nil
+	case "commit":
+		b, rpcErr := n.blockAt(req.Params)
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		return commitPayload(b, n.commitFormat), nil
+	case "validators":
+		b, rpcErr := n.blockAt(req.Params)
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		return validatorsPayload(b, req.Params, n.omitTotal)
+	case "block":
+		b, rpcErr := n.blockAt(req.Params)
+		if rpcErr != nil {
+			return nil, rpcErr
+		}
+		return map[string]interface{}{
+			"block": blockPayload(b),
+		}, nil
+	default:
+		return nil, &RPCError{Code: -32601, Message: "Method not found"}
+	}
+}
+
+// blockAt returns the block at the height given as the first parameter or the
+// latest block if no height was given.
+func (n *Node) blockAt(params []string) (*block, *RPCError) {
+	height := int64(len(n.blocks))
+	if len(params) > 0 && params[0] != "" {
+		h, err := strconv.ParseInt(params[0], 10, 64)
+		if err != nil {
+			return nil, &RPCError{Code: -32602, Message: "Invalid params", Data: err.Error()}
+		}
+		height = h
+	}
+	if height <= 0 {
+		return nil, &RPCError{
+			Code:    -32603,
+			Message: "Internal error",
+			Data:    "Height must be greater than 0",
+		}
+	}
+	if height > int64(len(n.blocks)) {
+		return nil, &RPCError{
+			Code:    -32603,
+			Message: "Internal error",
+			Data:    fmt.Sprintf("Height %d must be less than or equal to the current blockchain height %d", height, len(n.blocks)),
+		}
+	}
+	return n.blocks[height-1], nil
+}
+
+func hexUpper(b []byte) string {
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+func blockPayload(b *block) interface{} {
+	return map[string]interface{}{
+		"header": headerPayload(b),
+		"data": map[string]interface{}{
+			"txs": b.rawTxs,
+		},
+	}
+}
+
+func headerPayload(b *block) interface{} {
+	return map[string]interface{}{
+		"height":           strconv.FormatInt(b.height, 10),
+		"time":             b.Time.Format(time.RFC3339Nano),
+		"proposer_address": hexUpper(b.Proposer),
+		"validators_hash":  hexUpper(b.validatorsHash),
+	}
+}
+
+func commitPayload(b *block, format CommitFormat) interface{} {
+	commit := map[string]interface{}{
+		"block_id": map[string]interface{}{
+			"hash": hexUpper(b.hash),
+		},
+	}
+
+	switch format {
+	case SignaturesFormat:
+		signatures := make([]interface{}, len(b.Validators))
+		for i, v := range b.Validators {
+			switch {
+			case containsAddress(b.Signers, v.Address):
+				signatures[i] = map[string]interface{}{
+					"block_id_flag":     2,
+					"validator_address": hexUpper(v.Address),
+					"timestamp":         b.Time.Format(time.RFC3339Nano),
+					"signature":         v.Address,
+				}
+			case containsAddress(b.NilVoters, v.Address):
+				signatures[i] = map[string]interface{}{
+					"block_id_flag":     3,
+					"validator_address": hexUpper(v.Address),
+					"timestamp":         b.Time.Format(time.RFC3339Nano),
+					"signature":         v.Address,
+				}
+			default:
+				signatures[i] = map[string]interface{}{
+					"block_id_flag":     1,
+					"validator_address": "",
+					"timestamp":         "0001-01-01T00:00:00Z",
+					"signature":         nil,
+				}
+			}
+		}
+		commit["signatures"] = signatures
+	default:
+		// Only votes for the block are included. Validators that
+		// did not sign are represented by null.
+		precommits := make([]interface{}, len(b.Validators))
+		for i, v := range b.Validators {
+			if containsAddress(b.Signers, v.Address) {
+				precommits[i] = map[string]interface{}{
+					"validator_address": hexUpper(v.Address),
+					"validator_index":   strconv.Itoa(i),
+					"height":            strconv.FormatInt(b.height, 10),
+					"timestamp":         b.Time.Format(time.RFC3339Nano),
+					"block_id": map[string]interface{}{
+						"hash": hexUpper(b.hash),
+					},
+				}
+			}
+		}
+		commit["precommits"] = precommits
+	}
+
+	return map[string]interface{}{
+		"signed_header": map[string]interface{}{
+			"header": headerPayload(b),
+			"commit": commit,
+		},
+		"canonical": true,
+	}
+}
+
+func containsAddress(addresses [][]byte, address []byte) bool {
+	for _, a := range addresses {
+		if bytes.Equal(a, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// validatorsPayload returns a single page of the validator set. Page number
+// and size are the optional second and third parameters.
+func validatorsPayload(b *block, params []string, omitTotal bool) (interface{}, *RPCError) {
+	page, perPage := 1, defaultPerPage
+	var err error
+	if len(params) > 1 && params[1] != "" {
+		if page, err = strconv.Atoi(params[1]); err != nil {
+			return nil, &RPCError{Code: -32602, Message: "Invalid params", Data: err.Error()}
+		}
+	}
+	if len(params) > 2 && params[2] != "" {
+		if perPage, err = strconv.Atoi(params[2]); err != nil {
+			return nil, &RPCError{Code: -32602, Message: "Invalid params", Data: err.Error()}
+		}
+		if perPage < 1 || perPage > maxPerPage {
+			perPage = defaultPerPage
+		}
+	}
+	pages := (len(b.Validators) + perPage - 1) / perPage
+	if pages == 0 {
+		pages = 1
+	}
+	if page < 1 || page > pages {
+		return nil, &RPCError{
+			Code:    -32603,
+			Message: "Internal error",
+			Data:    fmt.Sprintf("page should be within [1, %d] range, given %d", pages, page),
+		}
+	}
+
+	from := (page - 1) * perPage
+	to := from + perPage
+	if to > len(b.Validators) {
+		to = len(b.Validators)
+	}
+	validators := make([]interface{}, 0, to-from)
+	for _, v := range b.Validators[from:to] {
+		validators = append(validators, validatorPayload(v))
+	}
+	payload := map[string]interface{}{
+		"block_height": strconv.FormatInt(b.height, 10),
+		"validators":   validators,
+	}
+	if !omitTotal {
+		payload["count"] = strconv.Itoa(len(validators))
+		payload["total"] = strconv.Itoa(len(b.Validators))
+	}
+	return payload, nil
+}
+
+// Pagination limits as used by tendermint.
+const (
+	defaultPerPage = 30
+	maxPerPage     = 100
+)
+
+func validatorPayload(v Validator) interface{} {
+	return map[string]interface{}{
+		"address": hexUpper(v.Address),
+		"pub_key": map[string]interface{}{
+			"type":  "tendermint/PubKeyEd25519",
+			"value": v.PubKey,
+		},
+		"voting_power":      strconv.FormatInt(v.VotingPower, 10),
+		"proposer_priority": "0",
+	}
+}
@@ -0,0 +1,127 @@
+package tmtest
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iov-one/block-metrics/pkg/metrics"
+	bnsd "github.com/iov-one/weave/cmd/bnsd/app"
+	"github.com/iov-one/weave/coin"
+	"github.com/iov-one/weave/x/cash"
+)
+
+func TestNode(t *testing.T) {
+	node := NewNode()
+	defer node.Close()
+
+	validators := []Validator{
+		{Address: []byte{0x01}, PubKey: []byte{0x11}, VotingPower: 10},
+		{Address: []byte{0x02}, PubKey: []byte{0x22}, VotingPower: 5},
+	}
+	blockTime := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	tx := &bnsd.Tx{
+		Sum: &bnsd.Tx_CashSendMsg{CashSendMsg: &cash.SendMsg{
+			Source:      []byte{0x01},
+			Destination: []byte{0x02},
+			Amount:      coin.NewCoinp(1, 0, "IOV"),
+		}},
+	}
+
+	node.AddBlock(Block{Time: blockTime, Validators: validators})
+	node.AddBlock(Block{
+		Time:     blockTime.Add(time.Second),
+		Proposer: []byte{0x02},
+		Signers:  [][]byte{{0x02}},
+		Txs:      []*bnsd.Tx{tx},
+	})
+
+	ws, err := metrics.DialTendermint(node.URL())
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer ws.Close()
+
+	clients := map[string]metrics.TendermintRPC{
+		"websocket": ws,
+		"http":      metrics.NewTendermintHTTPClient(node.HTTPURL()),
+	}
+
+	for name, c := range clients {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			info, err := metrics.AbciInfo(ctx, c)
+			if err != nil {
+				t.Fatalf("abci_info: %s", err)
+			}
+			if info.LastBlockHeight != 2 {
+				t.Fatalf("want height 2, got %d", info.LastBlockHeight)
+			}
+
+			commit, err := metrics.Commit(ctx, c, 2)
+			if err != nil {
+				t.Fatalf("commit: %s", err)
+			}
+			if !bytes.Equal(commit.Hash, node.BlockHash(2)) {
+				t.Fatalf("unexpected block hash %X", commit.Hash)
+			}
+			if !bytes.Equal(commit.ProposerAddress, []byte{0x02}) {
+				t.Fatalf("unexpected proposer %X", commit.ProposerAddress)
+			}
+			if want := [][]byte{{0x02}}; !reflect.DeepEqual(commit.ParticipantAddresses, want) {
+				t.Fatalf("unexpected participants %X", commit.ParticipantAddresses)
+			}
+			if !commit.Time.Equal(blockTime.Add(time.Second)) {
+				t.Fatalf("unexpected time %s", commit.Time)
+			}
+
+			vs, err := metrics.Validators(ctx, c, 2)
+			if err != nil {
+				t.Fatalf("validators: %s", err)
+			}
+			if len(vs) != 2 || !bytes.Equal(vs[1].PubKey, []byte{0x22}) {
+				t.Fatalf("unexpected validators %#v", vs)
+			}
+
+			block, err := metrics.FetchBlock(ctx, c, 2)
+			if err != nil {
+				t.Fatalf("block: %s", err)
+			}
+			if len(block.Transactions) != 1 || !reflect.DeepEqual(block.Transactions[0], tx) {
+				t.Fatalf("unexpected transactions %#v", block.Transactions)
+			}
+
+			if _, err := metrics.Commit(ctx, c, 3); !metrics.ErrHeightNotAvailable.Is(err) {
+				t.Fatalf("want height not available error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNodeHook(t *testing.T) {
+	node := NewNode()
+	defer node.Close()
+
+	node.AddBlock(Block{Validators: []Validator{{Address: []byte{0x01}, PubKey: []byte{0x11}}}})
+
+	var calls int
+	node.Hook(func(method string, params []string) *RPCError {
+		calls++
+		if calls == 1 {
+			return &RPCError{Code: -32603, Message: "Internal error", Data: "boom"}
+		}
+		return nil
+	})
+
+	c := metrics.NewTendermintHTTPClient(node.HTTPURL())
+	ctx := context.Background()
+	if _, err := metrics.AbciInfo(ctx, c); !metrics.ErrInternal.Is(err) {
+		t.Fatalf("want internal error, got %v", err)
+	}
+	if _, err := metrics.AbciInfo(ctx, c); err != nil {
+		t.Fatalf("want success after the scripted failure, got %s", err)
+	}
+}